@@ -0,0 +1,188 @@
+package gorpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// Rule lets, or with Deny refuses, callers use the methods matching Method.
+// Method is "Service.Method" or a pattern like "Service.*" or "*".
+// a rule without Principals and Roles applies to every caller, anonymous ones included,
+// "*" in Principals applies to every authenticated caller
+type Rule struct{
+	Method string
+	Principals []string `json:",omitempty"`
+	Roles []string `json:",omitempty"`
+	Deny bool `json:",omitempty"`
+}
+
+// Policy decides who may call what. the first rule matching the method and the caller wins,
+// calls no rule matches are denied
+type Policy struct{
+	Rules []Rule
+	// only log the calls the policy would deny and let them through, handy when rolling out a policy
+	DryRun bool `json:",omitempty"`
+}
+
+func (r *Rule)matches(method string, p *Principal)bool{
+	if ok, _ := path.Match(r.Method,method);!ok{
+		return false
+	}
+	if len(r.Principals) == 0 && len(r.Roles) == 0{
+		return true
+	}
+	if p == nil{
+		return false
+	}
+	for _, name := range r.Principals{
+		if name == "*" || name == p.Name{
+			return true
+		}
+	}
+	for _, role := range r.Roles{
+		if p.HasRole(role){
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether p may call method, p is nil for anonymous callers
+func (policy *Policy)Allowed(method string, p *Principal)bool{
+	for i := range policy.Rules{
+		if policy.Rules[i].matches(method,p){
+			return !policy.Rules[i].Deny
+		}
+	}
+	return false
+}
+
+func (policy *Policy)validate()error{
+	for _, r := range policy.Rules{
+		if _, err := path.Match(r.Method,"");err != nil{
+			return fmt.Errorf("rpc server: bad method pattern %q in policy",r.Method)
+		}
+	}
+	return nil
+}
+
+// ReadPolicyFile reads a policy written as json, like
+//	{"Rules": [{"Method": "Arith.*", "Roles": ["admin"]}, {"Method": "Arith.Sum", "Principals": ["*"]}]}
+func ReadPolicyFile(name string)(*Policy,error){
+	data, err := os.ReadFile(name)
+	if err != nil{
+		return nil, err
+	}
+	var policy Policy
+	if err := json.Unmarshal(data,&policy);err != nil{
+		return nil, fmt.Errorf("rpc server: policy %s: %v",name,err)
+	}
+	if err := policy.validate();err != nil{
+		return nil, err
+	}
+	return &policy,nil
+}
+
+// SetPolicy replaces the server's policy, requests already authorized are not affected.
+// a nil policy lets every caller call every method
+func (server *Server)SetPolicy(policy *Policy)error{
+	if policy != nil{
+		if err := policy.validate();err != nil{
+			return err
+		}
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.policy = policy
+	return nil
+}
+
+// LoadPolicyFile reads the policy from a file and installs it,
+// call it again, e.g. on SIGHUP, to pick up changes. on error the current policy stays
+func (server *Server)LoadPolicyFile(name string)error{
+	policy, err := ReadPolicyFile(name)
+	if err != nil{
+		return err
+	}
+	return server.SetPolicy(policy)
+}
+
+// WatchPolicyFile loads the policy from a file and reloads it whenever the file changes,
+// checking every interval until ctx is done. a broken file is logged and the previous policy kept
+func (server *Server)WatchPolicyFile(ctx context.Context, name string, interval time.Duration)error{
+	info, err := os.Stat(name)
+	if err != nil{
+		return err
+	}
+	if err := server.LoadPolicyFile(name);err != nil{
+		return err
+	}
+	go func(){
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		modTime, size := info.ModTime(),info.Size()
+		for{
+			select{
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			info, err := os.Stat(name)
+			if err != nil{
+				log.Println("rpc server: watch policy error:",err)
+				continue
+			}
+			if info.ModTime().Equal(modTime) && info.Size() == size{
+				continue
+			}
+			modTime, size = info.ModTime(),info.Size()
+			if err := server.LoadPolicyFile(name);err != nil{
+				log.Println("rpc server: reload policy error:",err)
+				continue
+			}
+			log.Println("rpc server: reloaded policy from",name)
+		}
+	}()
+	return nil
+}
+
+// the identified caller of a request: the principal from the authenticator,
+// else the verified tls client certificate, nil for anonymous callers
+func callerOf(ctx context.Context)*Principal{
+	if p, ok := PrincipalFromContext(ctx);ok{
+		return p
+	}
+	if peer, ok := PeerFromContext(ctx);ok && peer.Identity() != ""{
+		return &Principal{Name: peer.Identity()}
+	}
+	return nil
+}
+
+// check the request against the server's policy
+func (server *Server)authorize(ctx context.Context, req *request)error{
+	server.mu.Lock()
+	policy := server.policy
+	server.mu.Unlock()
+	if policy == nil{
+		return nil
+	}
+	method := req.svc.name+"."+req.mtype.method.Name
+	p := callerOf(ctx)
+	if policy.Allowed(method,p){
+		return nil
+	}
+	name := "anonymous caller"
+	if p != nil{
+		name = p.Name
+	}
+	if policy.DryRun{
+		log.Printf("rpc server: policy would deny %s calling %s",name,method)
+		return nil
+	}
+	return Errorf(PermissionDenied,"rpc server: %s may not call %s",name,method)
+}
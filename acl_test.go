@@ -0,0 +1,95 @@
+package gorpc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a server with Foo and Caller behind a static authenticator knowing alice (admin) and bob
+func newPolicyServer() *Server {
+	server := NewServer()
+	server.Authenticator = StaticAuthenticator{
+		"alice": {Name: "alice", Roles: []string{"admin"}},
+		"bob":   {Name: "bob"},
+	}
+	var foo Foo
+	var caller Caller
+	_ = server.Register(&foo)
+	_ = server.Register(&caller)
+	return server
+}
+
+func callAs(t *testing.T, server *Server, token string, serviceMethod string) error {
+	client := newPipeClient(t, server, &Option{Credentials: StaticCredentials(token)})
+	var reply interface{} = new(int)
+	if serviceMethod == "Caller.Name" {
+		reply = new(string)
+	}
+	return client.Call(context.Background(), serviceMethod, Args{Num1: 1, Num2: 2}, reply)
+}
+
+func TestPolicy(t *testing.T) {
+	server := newPolicyServer()
+	err := server.SetPolicy(&Policy{Rules: []Rule{
+		{Method: "Foo.*", Principals: []string{"bob"}, Deny: true},
+		{Method: "Foo.Sum", Principals: []string{"*"}},
+		{Method: "*", Roles: []string{"admin"}},
+	}})
+	_assert(err == nil, "failed to set policy: %v", err)
+
+	cases := []struct {
+		token, method string
+		allowed       bool
+	}{
+		{"alice", "Foo.Sum", true},
+		{"alice", "Caller.Name", true},
+		{"bob", "Foo.Sum", false}, // the deny rule comes first
+		{"bob", "Caller.Name", false},
+	}
+	for _, c := range cases {
+		err := callAs(t, server, c.token, c.method)
+		if c.allowed {
+			_assert(err == nil, "expect %s to call %s, got %v", c.token, c.method, err)
+		} else {
+			_assert(CodeOf(err) == PermissionDenied, "expect %s calling %s to be denied, got %v", c.token, c.method, err)
+		}
+	}
+
+	// dry run only logs
+	_ = server.SetPolicy(&Policy{DryRun: true})
+	err = callAs(t, server, "bob", "Foo.Sum")
+	_assert(err == nil, "expect dry run to let the call through, got %v", err)
+
+	_assert(server.SetPolicy(&Policy{Rules: []Rule{{Method: "Foo.["}}}) != nil, "expect bad pattern to be rejected")
+}
+
+func TestPolicyReload(t *testing.T) {
+	server := newPolicyServer()
+	name := filepath.Join(t.TempDir(), "policy.json")
+	write := func(policy string) {
+		if err := os.WriteFile(name, []byte(policy), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"Rules": [{"Method": "Foo.Sum", "Roles": ["admin"]}]}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := server.WatchPolicyFile(ctx, name, 10*time.Millisecond)
+	_assert(err == nil, "failed to load policy: %v", err)
+	_assert(CodeOf(callAs(t, server, "bob", "Foo.Sum")) == PermissionDenied, "expect bob to be denied")
+
+	// the watcher picks up the new file, the size differs so a coarse mtime does not matter
+	write(`{"Rules": [{"Method": "Foo.Sum", "Principals": ["bob", "alice"]}]}`)
+	deadline := time.Now().Add(2 * time.Second)
+	for callAs(t, server, "bob", "Foo.Sum") != nil {
+		_assert(time.Now().Before(deadline), "policy was not reloaded")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a broken file keeps the previous policy
+	_assert(server.LoadPolicyFile(filepath.Join(t.TempDir(), "missing.json")) != nil, "expect missing file to fail")
+	_assert(callAs(t, server, "bob", "Foo.Sum") == nil, "expect previous policy to stay")
+}
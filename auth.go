@@ -0,0 +1,232 @@
+package gorpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Principal is a caller the server's Authenticator accepted
+type Principal struct{
+	Name string
+	Roles []string
+}
+
+func (p *Principal)HasRole(role string)bool{
+	for _, r := range p.Roles{
+		if r == role{
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the authenticated caller of a request, for use in handlers and interceptors
+func PrincipalFromContext(ctx context.Context)(*Principal,bool){
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p,ok
+}
+
+// CredentialProvider supplies the token a client presents when it connects
+type CredentialProvider interface{
+	Token()(string,error)
+}
+
+// Authenticator accepts or rejects the token presented in the handshake.
+// ctx carries the connection's Peer, so tls identities can be taken into account
+type Authenticator interface{
+	Authenticate(ctx context.Context, token string)(*Principal,error)
+}
+
+var ErrInvalidToken = Errorf(Unauthenticated,"rpc server: invalid credentials")
+
+// StaticCredentials presents the same token on every connection
+type StaticCredentials string
+
+func (c StaticCredentials)Token()(string,error){
+	return string(c),nil
+}
+
+// StaticAuthenticator maps known tokens to their principal
+type StaticAuthenticator map[string]*Principal
+
+func (a StaticAuthenticator)Authenticate(ctx context.Context, token string)(*Principal,error){
+	p, ok := a[token]
+	if !ok{
+		return nil, ErrInvalidToken
+	}
+	return p,nil
+}
+
+// claims carried by signed tokens
+type tokenClaims struct{
+	Subject string `json:"sub"`
+	Roles []string `json:"roles,omitempty"`
+	Expires int64 `json:"exp,omitempty"` // unix seconds
+}
+
+func (c *tokenClaims)principal()(*Principal,error){
+	if c.Subject == ""{
+		return nil, ErrInvalidToken
+	}
+	if c.Expires != 0 && time.Now().Unix() >= c.Expires{
+		return nil, Errorf(Unauthenticated,"rpc server: credentials expired")
+	}
+	return &Principal{Name: c.Subject,Roles: c.Roles},nil
+}
+
+func newClaims(name string, roles []string, ttl time.Duration)*tokenClaims{
+	c := &tokenClaims{Subject: name,Roles: roles}
+	if ttl > 0{
+		c.Expires = time.Now().Add(ttl).Unix()
+	}
+	return c
+}
+
+var b64 = base64.RawURLEncoding
+
+// sign the dot separated parts, returning them with the signature appended
+func signParts(key []byte, parts ...string)string{
+	signed := strings.Join(parts,".")
+	mac := hmac.New(sha256.New,key)
+	mac.Write([]byte(signed))
+	return signed+"."+b64.EncodeToString(mac.Sum(nil))
+}
+
+// check the signature of token and return its unsigned parts
+func verifyParts(key []byte, token string, n int)([]string,error){
+	parts := strings.Split(token,".")
+	if len(parts) != n+1{
+		return nil, ErrInvalidToken
+	}
+	want := signParts(key,parts[:n]...)
+	if !hmac.Equal([]byte(want),[]byte(token)){
+		return nil, ErrInvalidToken
+	}
+	return parts[:n],nil
+}
+
+func encodeClaims(c *tokenClaims)(string,error){
+	data, err := json.Marshal(c)
+	if err != nil{
+		return "", err
+	}
+	return b64.EncodeToString(data),nil
+}
+
+func decodeClaims(s string)(*tokenClaims,error){
+	data, err := b64.DecodeString(s)
+	if err != nil{
+		return nil, ErrInvalidToken
+	}
+	var c tokenClaims
+	if err := json.Unmarshal(data,&c);err != nil{
+		return nil, ErrInvalidToken
+	}
+	return &c,nil
+}
+
+// HMACCredentials presents a token signed with a key shared with the server,
+// it is the claims in base64 followed by their HMAC-SHA256
+type HMACCredentials struct{
+	Name string
+	Roles []string
+	Key []byte
+	TTL time.Duration // 0 means the token never expires
+}
+
+func (c *HMACCredentials)Token()(string,error){
+	claims, err := encodeClaims(newClaims(c.Name,c.Roles,c.TTL))
+	if err != nil{
+		return "", err
+	}
+	return signParts(c.Key,claims),nil
+}
+
+// HMACAuthenticator accepts tokens made by HMACCredentials with the same key
+type HMACAuthenticator struct{
+	Key []byte
+}
+
+func (a *HMACAuthenticator)Authenticate(ctx context.Context, token string)(*Principal,error){
+	parts, err := verifyParts(a.Key,token,1)
+	if err != nil{
+		return nil, err
+	}
+	c, err := decodeClaims(parts[0])
+	if err != nil{
+		return nil, err
+	}
+	return c.principal()
+}
+
+// the only jwt header we produce and accept
+var jwtHeader = b64.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// JWTCredentials presents an HS256 JSON web token with sub, roles and exp claims
+type JWTCredentials struct{
+	Subject string
+	Roles []string
+	Key []byte
+	TTL time.Duration // 0 means the token never expires
+}
+
+func (c *JWTCredentials)Token()(string,error){
+	claims, err := encodeClaims(newClaims(c.Subject,c.Roles,c.TTL))
+	if err != nil{
+		return "", err
+	}
+	return signParts(c.Key,jwtHeader,claims),nil
+}
+
+// JWTAuthenticator accepts HS256 JSON web tokens signed with Key
+type JWTAuthenticator struct{
+	Key []byte
+}
+
+func (a *JWTAuthenticator)Authenticate(ctx context.Context, token string)(*Principal,error){
+	parts, err := verifyParts(a.Key,token,2)
+	if err != nil{
+		return nil, err
+	}
+	var header struct{
+		Alg string `json:"alg"`
+	}
+	data, err := b64.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data,&header) != nil || header.Alg != "HS256"{
+		return nil, ErrInvalidToken
+	}
+	c, err := decodeClaims(parts[1])
+	if err != nil{
+		return nil, err
+	}
+	return c.principal()
+}
+
+// the option as sent on the wire, with the client's token next to it
+type handshakeRequest struct{
+	*Option
+	Token string `json:",omitempty"`
+}
+
+// run the server's authenticator, a nil authenticator lets everyone in
+func (server *Server)authenticate(ctx context.Context, token string)(*Principal,error){
+	if server.Authenticator == nil{
+		return nil,nil
+	}
+	p, err := server.Authenticator.Authenticate(ctx,token)
+	if err == nil && p == nil{
+		err = errors.New("authenticator returned no principal")
+	}
+	if err != nil && CodeOf(err) != Unauthenticated{
+		err = Errorf(Unauthenticated,"rpc server: authentication failed: %v",err)
+	}
+	return p,err
+}
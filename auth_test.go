@@ -0,0 +1,81 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Caller tells the caller who the authenticator said it is
+type Caller int
+
+func (c Caller) Name(ctx context.Context, args Args, reply *string) error {
+	if p, ok := PrincipalFromContext(ctx); ok {
+		*reply = p.Name
+		if p.HasRole("admin") {
+			*reply += "+admin"
+		}
+	}
+	return nil
+}
+
+// connect to server over a pipe, returning the handshake error
+func dialPipe(server *Server, opt *Option) (*Client, error) {
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	opt, err := parseOptions(opt)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(cli, opt)
+}
+
+func TestAuthentication(t *testing.T) {
+	key := []byte("secret")
+	cases := []struct {
+		name  string
+		auth  Authenticator
+		creds CredentialProvider
+		want  string // empty when the connection must be refused
+	}{
+		{"static", StaticAuthenticator{"t0k3n": {Name: "alice", Roles: []string{"admin"}}}, StaticCredentials("t0k3n"), "alice+admin"},
+		{"static unknown token", StaticAuthenticator{"t0k3n": {Name: "alice"}}, StaticCredentials("guess"), ""},
+		{"anonymous", StaticAuthenticator{"t0k3n": {Name: "alice"}}, nil, ""},
+		{"hmac", &HMACAuthenticator{Key: key}, &HMACCredentials{Name: "bob", Key: key, TTL: time.Minute}, "bob"},
+		{"hmac wrong key", &HMACAuthenticator{Key: key}, &HMACCredentials{Name: "bob", Key: []byte("other")}, ""},
+		{"hmac expired", &HMACAuthenticator{Key: key}, &HMACCredentials{Name: "bob", Key: key, TTL: time.Nanosecond}, ""}, // expires within the current second
+		{"jwt", &JWTAuthenticator{Key: key}, &JWTCredentials{Subject: "carol", Roles: []string{"admin"}, Key: key}, "carol+admin"},
+		{"jwt given to hmac", &HMACAuthenticator{Key: key}, &JWTCredentials{Subject: "carol", Key: key}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := NewServer()
+			server.Authenticator = c.auth
+			var caller Caller
+			_ = server.Register(&caller)
+			client, err := dialPipe(server, &Option{Credentials: c.creds})
+			if c.want == "" {
+				var e *Error
+				_assert(errors.As(err, &e) && e.Code == Unauthenticated, "expect Unauthenticated, got %v", err)
+				return
+			}
+			_assert(err == nil, "failed to connect: %v", err)
+			defer func() { _ = client.Close() }()
+			var name string
+			err = client.Call(context.Background(), "Caller.Name", Args{}, &name)
+			_assert(err == nil && name == c.want, "expect %q, got %q, %v", c.want, name, err)
+		})
+	}
+}
+
+func TestNoAuthenticatorAcceptsEveryone(t *testing.T) {
+	server := NewServer()
+	var caller Caller
+	_ = server.Register(&caller)
+	client := newPipeClient(t, server, &Option{Credentials: StaticCredentials("ignored")})
+	var name string
+	err := client.Call(context.Background(), "Caller.Name", Args{}, &name)
+	_assert(err == nil && name == "", "expect anonymous call, got %q, %v", name, err)
+}
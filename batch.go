@@ -0,0 +1,208 @@
+package gorpc
+
+import (
+	"context"
+	"gorpc/codec"
+	"reflect"
+	"sync"
+)
+
+// Batch collects calls and sends them to the server as a single request. the server runs them
+// concurrently, or one after another in the order they were added when Ordered is set,
+// and answers them all in a single response. a batch longer than the server's
+// MaxBatchItems fails as a whole with ResourceExhausted
+type Batch struct{
+	Ordered bool
+	client *Client
+	calls []*Call
+}
+
+// Batch starts an empty batch of calls on the client
+func (client *Client)Batch()*Batch{
+	return &Batch{client: client}
+}
+
+// Add queues a call for the next Do. the call's Error and Reply are filled in by Do,
+// nothing is sent on its Done channel
+func (b *Batch)Add(serviceMethod string, args, reply interface{})*Call{
+	call := &Call{ServiceMethod: serviceMethod,Args: args,Reply: reply}
+	b.calls = append(b.calls,call)
+	return call
+}
+
+// Do sends the queued calls and waits for their results, every call gets its own error.
+// the returned error is about the batch as a whole, like ctx being done or the connection failing,
+// then every call fails with it. the outgoing metadata and deadline of ctx apply to all calls,
+// the trailers they set are merged. client interceptors do not run, the batch is empty again afterwards
+func (b *Batch)Do(ctx context.Context)error{
+	calls := b.calls
+	b.calls = nil
+	if len(calls) == 0{
+		return nil
+	}
+	s, ok := codec.LookupSerializer(b.client.codecType)
+	if !ok{
+		err := Errorf(InvalidArgument,"rpc client: codec %s cannot carry batches",b.client.codecType)
+		for _, call := range calls{
+			call.Error = err
+		}
+		return err
+	}
+	// arguments that cannot be encoded fail their own call, the rest is sent
+	batch := &codec.Batch{Ordered: b.Ordered}
+	var sent []*Call
+	for _, call := range calls{
+		body, err := s.Marshal(call.Args)
+		if err != nil{
+			call.Error = Errorf(InvalidArgument,"rpc client: encode args error: %v",err)
+			continue
+		}
+		batch.Items = append(batch.Items,codec.BatchItem{ServiceMethod: call.ServiceMethod,Body: body})
+		sent = append(sent,call)
+	}
+	if len(sent) == 0{
+		return nil
+	}
+
+	md, _ := OutgoingMetadata(ctx)
+	deadline, _ := ctx.Deadline()
+	reply := new(codec.Batch)
+	call := &Call{
+		Args: batch,
+		Reply: reply,
+		Done: make(chan *Call,1),
+		Metadata: md,
+		deadline: deadline,
+		kind: codec.KindBatch,
+	}
+	b.client.send(call)
+	err := b.client.wait(ctx,call)
+	if err == nil && len(reply.Items) != len(sent){
+		err = Errorf(Internal,"rpc client: batch of %d calls answered with %d results",len(sent),len(reply.Items))
+	}
+	if err != nil{
+		for _, c := range sent{
+			c.Error = err
+		}
+		return err
+	}
+	for i, item := range reply.Items{
+		c := sent[i]
+		c.Trailer = call.Trailer
+		h := &codec.Header{Error: item.Error,Code: item.Code,Details: item.Details}
+		if err := headerError(h);err != nil{
+			c.Error = err
+			continue
+		}
+		if err := s.Unmarshal(item.Body,c.Reply);err != nil{
+			c.Error = Errorf(Internal,"reading body %v",err)
+		}
+	}
+	return nil
+}
+
+const (
+	// DefaultMaxBatchItems is the most calls a batch may carry when Server.MaxBatchItems is 0
+	DefaultMaxBatchItems = 1024
+	// calls of an unordered batch running at once
+	batchWorkers = 32
+)
+
+// run the calls of a batch and put their results into a batch reply,
+// a call failing only fails its own result
+func(server *Server)runBatch(ctx context.Context, req *request)error{
+	if req.serializer == nil{
+		return Errorf(Internal,"rpc server: the connection's codec cannot carry batches")
+	}
+	items := req.batch.Items
+	limit := server.MaxBatchItems
+	if limit <= 0{
+		limit = DefaultMaxBatchItems
+	}
+	if len(items) > limit{
+		return Errorf(ResourceExhausted,"rpc server: batch of %d calls is over the limit of %d",len(items),limit)
+	}
+	results := make([]codec.BatchItem,len(items))
+	if req.batch.Ordered{
+		for i := range items{
+			results[i] = server.runBatchItem(ctx,&items[i],req.serializer)
+		}
+	}else{
+		// a few workers take the calls in turn, however long the batch
+		workers := batchWorkers
+		if len(items) < workers{
+			workers = len(items)
+		}
+		next := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0;w < workers;w++{
+			wg.Add(1)
+			go func(){
+				defer wg.Done()
+				for i := range next{
+					results[i] = server.runBatchItem(ctx,&items[i],req.serializer)
+				}
+			}()
+		}
+		for i := range items{
+			next <- i
+		}
+		close(next)
+		wg.Wait()
+	}
+	req.replyv = reflect.ValueOf(&codec.Batch{Ordered: req.batch.Ordered,Items: results})
+	return nil
+}
+
+func(server *Server)runBatchItem(ctx context.Context, item *codec.BatchItem, s codec.Serializer)codec.BatchItem{
+	result := codec.BatchItem{ServiceMethod: item.ServiceMethod}
+	body, err := server.callBatchItem(ctx,item,s)
+	if err != nil{
+		e := toError(err)
+		result.Error, result.Code, result.Details = e.Message,uint32(e.Code),e.Details
+		return result
+	}
+	result.Body = body
+	return result
+}
+
+// a single call of a batch goes through the same checks as a request of its own
+func(server *Server)callBatchItem(ctx context.Context, item *codec.BatchItem, s codec.Serializer)([]byte,error){
+	// the batch was cancelled or timed out before this call's turn came
+	if err := ctx.Err();err != nil{
+		return nil, Errorf(CodeOf(err),"rpc server: batch stopped: %v",err)
+	}
+	svc, mtype, err := server.findService(item.ServiceMethod)
+	if err != nil{
+		return nil, err
+	}
+	if mtype.kind() != codec.KindCall{
+		return nil, Errorf(InvalidArgument,"rpc server: %s is a streaming method and cannot be batched",item.ServiceMethod)
+	}
+	req := &request{h: &codec.Header{ServiceMethod: item.ServiceMethod},svc: svc,mtype: mtype}
+	req.argv, req.replyv = mtype.newArgv(),mtype.newReplyv()
+	argvi := req.argv.Interface()
+	// if arguement is not a pointer
+	if req.argv.Type().Kind() != reflect.Ptr{
+		argvi = req.argv.Addr().Interface()
+	}
+	if err := s.Unmarshal(item.Body,argvi);err != nil{
+		return nil, Errorf(InvalidArgument,"rpc server: read argv error: %v",err)
+	}
+	if err := server.authorize(ctx,req);err != nil{
+		return nil, err
+	}
+	// the service may have been unregistered since it was found
+	if !svc.begin(){
+		return nil, Errorf(NotFound,"rpc server: cannot find service")
+	}
+	defer svc.done()
+	if err := server.safeInvoke(ctx,req);err != nil{
+		return nil, err
+	}
+	body, err := s.Marshal(req.replyv.Interface())
+	if err != nil{
+		return nil, Errorf(Internal,"rpc server: encode reply error: %v",err)
+	}
+	return body,nil
+}
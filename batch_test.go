@@ -0,0 +1,176 @@
+package gorpc
+
+import (
+	"context"
+	"gorpc/codec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Ledger records the order its entries arrive in
+type Ledger struct {
+	mu      sync.Mutex
+	entries []int
+	// Wait holds every caller until the channel is full, so only concurrent calls get through
+	waiting chan struct{}
+	// Busy counts the calls running at once, and the most it saw
+	running, peak int
+}
+
+func (l *Ledger) Append(n int, reply *int) error {
+	time.Sleep(time.Millisecond)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, n)
+	*reply = len(l.entries)
+	return nil
+}
+
+func (l *Ledger) Wait(n int, reply *int) error {
+	l.waiting <- struct{}{}
+	for len(l.waiting) < cap(l.waiting) {
+		time.Sleep(time.Millisecond)
+	}
+	*reply = n
+	return nil
+}
+
+func (l *Ledger) Busy(n int, reply *int) error {
+	l.mu.Lock()
+	l.running++
+	if l.running > l.peak {
+		l.peak = l.running
+	}
+	l.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	l.mu.Lock()
+	l.running--
+	l.mu.Unlock()
+	*reply = n
+	return nil
+}
+
+func TestBatch(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	var tenant Tenant
+	_ = server.Register(&foo)
+	_ = server.Register(&tenant)
+	_ = server.Register(make(Logs, 1))
+	opts := map[string]*Option{
+		"gob":        nil,
+		"json":       {CodecType: codec.JsonType},
+		"msgpack":    {CodecType: codec.MsgpackType, Framing: true},
+		"gob framed": {CodecType: codec.GobType, Compression: "gzip"},
+	}
+	for name, opt := range opts {
+		t.Run(name, func(t *testing.T) {
+			client := newPipeClient(t, server, opt)
+			batch := client.Batch()
+			sums := make([]int, 5)
+			var calls []*Call
+			for i := range sums {
+				calls = append(calls, batch.Add("Foo.Sum", Args{Num1: i, Num2: i}, &sums[i]))
+			}
+			var s string
+			unknown := batch.Add("Foo.Unknown", Args{}, &s)
+			failed := batch.Add("Tenant.Fail", Args{Num1: int(PermissionDenied)}, &s)
+			stream := batch.Add("Logs.Tail", Args{}, &s)
+			_assert(batch.Do(context.Background()) == nil, "expect batch to be sent")
+
+			for i, call := range calls {
+				_assert(call.Error == nil && sums[i] == 2*i, "expect sum %d, got %d, %v", 2*i, sums[i], call.Error)
+			}
+			_assert(CodeOf(unknown.Error) == NotFound, "expect NotFound, got %v", unknown.Error)
+			e, ok := failed.Error.(*Error)
+			_assert(ok && e.Code == PermissionDenied && e.Details["tenant"] == "t1", "expect structured error, got %#v", failed.Error)
+			_assert(CodeOf(stream.Error) == InvalidArgument, "expect streams to be refused, got %v", stream.Error)
+
+			// the batch is empty again, and the connection carries on
+			_assert(batch.Do(context.Background()) == nil, "expect empty batch to do nothing")
+			var sum int
+			err := client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+			_assert(err == nil && sum == 3, "expect call after batch to work, got %d, %v", sum, err)
+		})
+	}
+}
+
+func TestBatchOrder(t *testing.T) {
+	server := NewServer()
+	ledger := &Ledger{waiting: make(chan struct{}, 10)}
+	_ = server.Register(ledger)
+	client := newPipeClient(t, server, nil)
+
+	// in order, each call sees the ones before it done
+	batch := client.Batch()
+	batch.Ordered = true
+	replies := make([]int, 10)
+	for i := range replies {
+		batch.Add("Ledger.Append", i, &replies[i])
+	}
+	_assert(batch.Do(context.Background()) == nil, "expect batch to be sent")
+	for i := range replies {
+		_assert(ledger.entries[i] == i && replies[i] == i+1, "expect entry %d in order, got %v", i, ledger.entries)
+	}
+
+	// otherwise the calls run at once, the waits only return when all of them are running
+	batch = client.Batch()
+	for i := range replies {
+		batch.Add("Ledger.Wait", i, &replies[i])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_assert(batch.Do(ctx) == nil, "expect concurrent calls to meet")
+	for i := range replies {
+		_assert(replies[i] == i, "expect reply %d, got %d", i, replies[i])
+	}
+}
+
+func TestBatchCancel(t *testing.T) {
+	server := NewServer()
+	var tenant Tenant
+	_ = server.Register(&tenant)
+	client := newPipeClient(t, server, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	batch := client.Batch()
+	batch.Ordered = true
+	var s string
+	slow := batch.Add("Tenant.Slow", Args{Num1: 100}, &s)
+	next := batch.Add("Tenant.Slow", Args{Num1: 100}, &s)
+	err := batch.Do(ctx)
+	_assert(CodeOf(err) == DeadlineExceeded, "expect the batch to time out, got %v", err)
+	_assert(slow.Error == err && next.Error == err, "expect every call to fail with the batch")
+}
+
+func TestBatchLimits(t *testing.T) {
+	server := NewServer()
+	server.MaxBatchItems = 200
+	ledger := &Ledger{}
+	_ = server.Register(ledger)
+	client := newPipeClient(t, server, nil)
+
+	// too many calls fail the batch as a whole
+	batch := client.Batch()
+	var reply int
+	var calls []*Call
+	for i := 0; i <= server.MaxBatchItems; i++ {
+		calls = append(calls, batch.Add("Ledger.Busy", i, &reply))
+	}
+	err := batch.Do(context.Background())
+	_assert(CodeOf(err) == ResourceExhausted, "expect ResourceExhausted, got %v", err)
+	_assert(calls[0].Error == err && calls[len(calls)-1].Error == err, "expect every call to fail with the batch")
+
+	// the rest run on a bounded number of workers
+	replies := make([]int, server.MaxBatchItems)
+	for i := range replies {
+		batch.Add("Ledger.Busy", i, &replies[i])
+	}
+	_assert(batch.Do(context.Background()) == nil, "expect batch to be sent")
+	for i := range replies {
+		_assert(replies[i] == i, "expect reply %d, got %d", i, replies[i])
+	}
+	_assert(ledger.peak > 1 && ledger.peak <= batchWorkers, "expect at most %d calls at once, got %d", batchWorkers, ledger.peak)
+}
@@ -0,0 +1,187 @@
+package gorpc
+
+import (
+	"context"
+	"gorpc/codec"
+	"log"
+	"sync"
+)
+
+// Callback calls the methods a client registered with Client.Register, over the connection
+// the request arrived on, so servers can push to clients that cannot be dialed
+type Callback struct{
+	cc codec.Codec
+	sending *sync.Mutex // shared with the responses of the connection
+	mu sync.Mutex // protect following
+	seq uint64
+	pending map[uint64]*Call
+	err error // set once the connection is gone
+}
+
+type callbackKey struct{}
+
+// CallbackFromContext returns the Callback of the connection a request arrived on, for use in handlers
+func CallbackFromContext(ctx context.Context)(*Callback,bool){
+	cb, ok := ctx.Value(callbackKey{}).(*Callback)
+	return cb,ok
+}
+
+func newCallback(cc codec.Codec, sending *sync.Mutex)*Callback{
+	return &Callback{cc: cc,sending: sending,pending: make(map[uint64]*Call)}
+}
+
+// Call calls serviceMethod on the client and waits for its reply. the outgoing metadata
+// and deadline of ctx go along, once ctx is done the reply is no longer waited for
+func (cb *Callback)Call(ctx context.Context, serviceMethod string, args, reply interface{})error{
+	md, _ := OutgoingMetadata(ctx)
+	call := &Call{ServiceMethod: serviceMethod,Args: args,Reply: reply,Done: make(chan *Call,1),Metadata: md}
+	cb.mu.Lock()
+	if cb.err != nil{
+		cb.mu.Unlock()
+		return cb.err
+	}
+	cb.seq++
+	call.Seq = cb.seq
+	cb.pending[call.Seq] = call
+	cb.mu.Unlock()
+
+	h := &codec.Header{ServiceMethod: serviceMethod,Seq: call.Seq,Kind: codec.KindCallback,Metadata: md}
+	if deadline, ok := ctx.Deadline();ok{
+		h.Timeout = timeoutOf(deadline)
+	}
+	if err := cb.write(h,args);err != nil{
+		cb.remove(call.Seq)
+		return err
+	}
+	select{
+	case <-ctx.Done():
+		cb.remove(call.Seq)
+		return Errorf(CodeOf(ctx.Err()),"rpc server: callback failed: %v",ctx.Err())
+	case call := <-call.Done:
+		if sink, ok := ctx.Value(trailerSinkKey{}).(*Metadata);ok && sink != nil{
+			*sink = call.Trailer
+		}
+		return call.Error
+	}
+}
+
+// Notify calls serviceMethod on the client without waiting for a reply, the client sends none
+func (cb *Callback)Notify(serviceMethod string, args interface{})error{
+	cb.mu.Lock()
+	err := cb.err
+	cb.mu.Unlock()
+	if err != nil{
+		return err
+	}
+	return cb.write(&codec.Header{ServiceMethod: serviceMethod,Kind: codec.KindNotify},args)
+}
+
+func (cb *Callback)write(h *codec.Header, body interface{})error{
+	cb.sending.Lock()
+	defer cb.sending.Unlock()
+	return cb.cc.Write(h,body)
+}
+
+func (cb *Callback)remove(seq uint64)*Call{
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	call := cb.pending[seq]
+	delete(cb.pending,seq)
+	return call
+}
+
+// read the client's reply into the waiting call, replies nobody waits for are dropped
+func (cb *Callback)receive(cc codec.Codec, h *codec.Header){
+	call := cb.remove(h.Seq)
+	if call == nil{
+		_ = cc.ReadBody(nil)
+		return
+	}
+	call.Trailer = h.Metadata
+	if err := headerError(h);err != nil{
+		call.Error = err
+		_ = cc.ReadBody(nil)
+	}else if err := cc.ReadBody(call.Reply);err != nil{
+		call.Error = Errorf(Internal,"rpc server: read callback reply error: %v",err)
+	}
+	call.Done <- call
+}
+
+// the connection is gone, fail the callbacks still waiting
+func (cb *Callback)terminate(){
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.err = ErrShutdown
+	for seq, call := range cb.pending{
+		call.Error = ErrShutdown
+		call.Done <- call
+		delete(cb.pending,seq)
+	}
+}
+
+// Register publishes the methods of rcvr for the server to call back, like Server.Register
+func (client *Client)Register(rcvr interface{})error{
+	return client.callbacks.Register(rcvr)
+}
+
+// RegisterName publishes the methods of rcvr under name for the server to call back
+func (client *Client)RegisterName(name string, rcvr interface{})error{
+	return client.callbacks.RegisterName(name,rcvr)
+}
+
+// read a callback or notification from the server and run it away from the receive loop
+func (client *Client)serveCallback(h *codec.Header)error{
+	notify := h.Kind == codec.KindNotify
+	seq := h.Seq
+	// from here on it is an ordinary request to our own services
+	h.Kind = codec.KindCall
+	req, err := client.callbacks.readRequestBody(client.cc,h)
+	if err != nil{
+		if notify{
+			log.Printf("rpc client: notification %s error: %v",h.ServiceMethod,err)
+			return nil
+		}
+		reply := &codec.Header{ServiceMethod: h.ServiceMethod,Seq: seq,Kind: codec.KindCallbackReply}
+		setHeaderError(reply,err)
+		// a sender may hold the connection waiting for the server, which waits for us to read
+		go func(){
+			if err := client.write(reply,invalidRequest);err != nil{
+				log.Println("rpc client: send callback reply error:",err)
+			}
+		}()
+		return nil
+	}
+	go client.runCallback(req,notify)
+	return nil
+}
+
+func (client *Client)runCallback(req *request, notify bool){
+	ctx := context.Background()
+	if !req.deadline.IsZero(){
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx,req.deadline)
+		defer cancel()
+	}
+	ctx, tr := newRequestContext(ctx,req.h.Metadata)
+	var err error = Errorf(NotFound,"rpc client: cannot find service")
+	if req.svc.begin(){
+		err = client.callbacks.safeInvoke(ctx,req)
+		req.svc.done()
+	}
+	if notify{
+		if err != nil{
+			log.Printf("rpc client: notification %s failed: %v",req.h.ServiceMethod,err)
+		}
+		return
+	}
+	h := &codec.Header{ServiceMethod: req.h.ServiceMethod,Seq: req.h.Seq,Kind: codec.KindCallbackReply,Metadata: tr.get()}
+	var body interface{} = invalidRequest
+	if err != nil{
+		setHeaderError(h,err)
+	}else{
+		body = req.replyv.Interface()
+	}
+	if err := client.write(h,body);err != nil{
+		log.Println("rpc client: send callback reply error:",err)
+	}
+}
@@ -0,0 +1,106 @@
+package gorpc
+
+import (
+	"context"
+	"gorpc/codec"
+	"testing"
+	"time"
+)
+
+// Progress lives on the client and hears how a job is going
+type Progress chan int
+
+func (p Progress) Report(ctx context.Context, args Args, reply *int) error {
+	md, _ := IncomingMetadata(ctx)
+	if md.Get("job") != "j1" {
+		return Errorf(InvalidArgument, "unexpected job %q", md.Get("job"))
+	}
+	p <- args.Num1
+	*reply = args.Num1 * 2
+	return nil
+}
+
+// Job runs on the server and reports back to its caller
+type Job int
+
+func (j Job) Run(ctx context.Context, args Args, reply *int) error {
+	cb, ok := CallbackFromContext(ctx)
+	if !ok {
+		return Errorf(Internal, "no callback")
+	}
+	ctx = NewOutgoingContext(ctx, Metadata{"job": "j1"})
+	for i := 0; i < args.Num1; i++ {
+		var doubled int
+		if err := cb.Call(ctx, "Progress.Report", Args{Num1: i}, &doubled); err != nil {
+			return err
+		}
+		*reply += doubled
+	}
+	return cb.Notify("Progress.Report", Args{Num1: -1})
+}
+
+func (j Job) Missing(ctx context.Context, args Args, reply *int) error {
+	cb, _ := CallbackFromContext(ctx)
+	return cb.Call(ctx, "Progress.Unknown", args, reply)
+}
+
+func TestCallback(t *testing.T) {
+	server := NewServer()
+	var job Job
+	_ = server.Register(&job)
+	for _, opt := range []*Option{nil, {CodecType: codec.JsonType}, {CodecType: codec.MsgpackType, Framing: true}} {
+		client := newPipeClient(t, server, opt)
+		progress := make(Progress, 10)
+		_assert(client.Register(progress) == nil, "failed to register callback service")
+
+		var sum int
+		err := client.Call(context.Background(), "Job.Run", Args{Num1: 4}, &sum)
+		_assert(err == nil && sum == 2*(0+1+2+3), "expect callbacks to be answered, got %d, %v", sum, err)
+		for i := 0; i < 4; i++ {
+			_assert(<-progress == i, "expect progress %d", i)
+		}
+		// the notification carries no metadata, so the handler fails and nothing is answered
+		select {
+		case n := <-progress:
+			t.Fatalf("unexpected progress %d", n)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		err = client.Call(context.Background(), "Job.Missing", Args{}, &sum)
+		_assert(CodeOf(err) == NotFound, "expect NotFound for an unknown callback, got %v", err)
+	}
+}
+
+func TestCallbackAfterDisconnect(t *testing.T) {
+	cb := newCallback(nil, nil)
+	cb.terminate()
+	err := cb.Call(context.Background(), "Progress.Report", Args{}, new(int))
+	_assert(err == ErrShutdown, "expect ErrShutdown once the connection is gone, got %v", err)
+	_assert(cb.Notify("Progress.Report", Args{}) == ErrShutdown, "expect notify to fail as well")
+}
+
+func TestCallbackErrorDoesNotBlockReceive(t *testing.T) {
+	server := NewServer()
+	var job Job
+	var tenant Tenant
+	_ = server.Register(&job)
+	_ = server.Register(&tenant)
+	client := newPipeClient(t, server, nil)
+
+	var s string
+	var n int
+	slow := client.Go("Tenant.Slow", Args{Num1: 100}, &s, nil)
+	missing := client.Go("Job.Missing", Args{}, &n, nil)
+	// a sender stuck on the connection, the receive loop has to keep reading regardless
+	client.sending.Lock()
+	select {
+	case call := <-slow.Done:
+		_assert(call.Error == nil && s == "slow done", "expect slow call to finish, got %v", call.Error)
+	case <-time.After(time.Second):
+		client.sending.Unlock()
+		t.Fatal("receive loop blocked answering a failed callback")
+	}
+	client.sending.Unlock()
+	call := <-missing.Done
+	_assert(CodeOf(call.Error) == NotFound, "expect NotFound for an unknown callback, got %v", call.Error)
+}
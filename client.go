@@ -23,9 +23,18 @@ type Call struct{
 	Reply interface{}
 	Error error
 	Done chan *Call
+	Metadata Metadata // sent with the request
+	Trailer Metadata // sent back by the server with the response
+	deadline time.Time // sent along so the server can give up when we do
+	stream *ClientStream // set for streaming calls, which end through the stream instead of Done
+	kind codec.Kind // what the request is, streams tell their own kind
 }
 
 func (call *Call)done(){
+	if call.stream != nil{
+		call.stream.finish(call.Error,call.Trailer)
+		return
+	}
 	call.Done <- call
 }
 
@@ -35,6 +44,7 @@ func (call *Call)done(){
 type Client struct{
 	cc codec.Codec
 	opt *Option
+	codecType codec.Type // codec chosen in the handshake
 	// sending process needs to be sequential
 	sending sync.Mutex // protect
 	header codec.Header
@@ -44,11 +54,13 @@ type Client struct{
 	pending map[uint64]*Call //ongoing calls
 	closing bool // client send stop
 	shutdown bool // server send stop
+	goAway bool // server is draining, pending calls still complete
+	callbacks *Server // methods the server may call back, see Client.Register
 }
 
 var _ io.Closer = (*Client)(nil)
 // any call while the client is shutting down will trigger this function
-var ErrShutdown = errors.New("connection is shut down")
+var ErrShutdown = Errorf(Unavailable,"connection is shut down")
 
 // close current client
 func(client *Client)Close()error{
@@ -65,16 +77,27 @@ func(client *Client)Close()error{
 func (client *Client)IsAvailable()bool{
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	return !client.shutdown && !client.closing
+	return !client.shutdown && !client.closing && !client.goAway
+}
+
+// whether new requests may be sent, client.mu must be held
+func(client *Client)usable()error{
+	// client cannot be shut down or closing
+	if client.closing || client.shutdown{
+		return ErrShutdown
+	}
+	if client.goAway{
+		return ErrServerClosed
+	}
+	return nil
 }
 
 // this will register a call in client
 func(client *Client)registerCall(call *Call)(uint64,error){
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	// client cannot be shut down or closing
-	if client.closing || client.shutdown{
-		return 0,ErrShutdown
+	if err := client.usable();err != nil{
+		return 0,err
 	}
 	// call will have unique id
 	call.Seq = client.seq
@@ -98,7 +121,7 @@ func(client *Client)removeCall(seq uint64)*Call{
 func(client *Client)terminateCalls(err error){
 	// hold lock for any sending or operation
 	client.sending.Lock()
-	defer client.sending.Lock()
+	defer client.sending.Unlock()
 	client.mu.Lock()
 	defer client.mu.Unlock()
 
@@ -118,14 +141,35 @@ func(client *Client)receive(){
 		if err = client.cc.ReadHeader(&h);err != nil{
 			break
 		}
+		if h.Kind == codec.KindGoAway{
+			client.mu.Lock()
+			client.goAway = true
+			client.mu.Unlock()
+			err = client.cc.ReadBody(nil)
+			continue
+		}
+		// the server calling us back, and notifying us
+		if h.Kind == codec.KindCallback || h.Kind == codec.KindNotify{
+			err = client.serveCallback(&h)
+			continue
+		}
+		// stream messages leave the call pending, the final response ends it
+		if h.Kind == codec.KindStreamMsg || h.Kind == codec.KindWindowUpdate{
+			err = client.receiveStream(&h)
+			continue
+		}
 		call := client.removeCall(h.Seq)
+		if call != nil{
+			call.Trailer = h.Metadata
+		}
+		callErr := headerError(&h)
 		switch{
 		case call == nil:
 			// request not sent completely or cancled, by still processed the server
 			err = client.cc.ReadBody(nil)
-		case h.Error != "":
+		case callErr != nil:
 			// serverside return an error back
-			call.Error = fmt.Errorf(h.Error)
+			call.Error = callErr
 			err = client.cc.ReadBody(nil)
 			call.done()
 		default:
@@ -133,13 +177,25 @@ func(client *Client)receive(){
 			err = client.cc.ReadBody(call.Reply)
 			if err != nil{
 				// if reading error occurs place it into call error
-				call.Error = errors.New("reading body "+err.Error())
+				call.Error = Errorf(Internal,"reading body %v",err)
 			}
 			call.done()
 		}
 	}
-	// if an error occurs, terminate all calls
-	client.terminateCalls(err)
+	// if an error occurs, terminate all calls. none of them got an answer,
+	// so they fail as Unavailable whatever broke the connection
+	client.terminateCalls(Errorf(Unavailable,"rpc client: connection lost: %v",err))
+}
+
+// the time left until deadline, as it is put on the wire. the clocks at both ends
+// may disagree, so the receiver counts it from when the message arrives.
+// a deadline already past still sends a timeout, 0 would mean none
+func timeoutOf(deadline time.Time)int64{
+	d := time.Until(deadline)
+	if d <= 0{
+		d = 1
+	}
+	return int64(d)
 }
 
 func(client *Client)send(call *Call){
@@ -157,6 +213,17 @@ func(client *Client)send(call *Call){
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Seq = seq
 	client.header.Error = ""
+	client.header.Metadata = call.Metadata
+	client.header.Kind = call.kind
+	client.header.Window = 0
+	if call.stream != nil{
+		client.header.Kind = call.stream.kind
+		client.header.Window = uint32(call.stream.size)
+	}
+	client.header.Timeout = 0
+	if !call.deadline.IsZero(){
+		client.header.Timeout = timeoutOf(call.deadline)
+	}
 	// encode and send request to the server
 	if err := client.cc.Write(&client.header,call.Args);err != nil{
 		call := client.removeCall(call.Seq)
@@ -169,32 +236,106 @@ func(client *Client)send(call *Call){
 	}
 }
 
+// tell the server we no longer wait for the call with this seq
+func(client *Client)sendCancel(seq uint64){
+	h := &codec.Header{Seq: seq,Kind: codec.KindCancel}
+	if err := client.write(h,struct{}{});err != nil{
+		log.Println("rpc client: send cancel error:",err)
+	}
+}
+
+// send a message that is not a request, like a stream message or a control message
+func(client *Client)write(h *codec.Header, body interface{})error{
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	return client.cc.Write(h,body)
+}
+
 func(client *Client)Go(serviceMethod string, args, reply interface{}, done chan *Call)*Call{
+	if len(client.opt.Interceptors) == 0{
+		return client.goContext(context.Background(),serviceMethod,args,reply,done)
+	}
+	if done == nil{
+		done = make(chan *Call,10)
+	}else if cap(done) == 0{
+		log.Panic("rpc client: done channl is unbuffered")
+	}
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args: args,
+		Reply: reply,
+		Done: done,
+	}
+	// interceptors may block, run them away from the caller
+	go func(){
+		call.Error = client.intercept(func(ctx context.Context, serviceMethod string, args, reply interface{})error{
+			sent := <-client.goContext(ctx,serviceMethod,args,reply,make(chan *Call,1)).Done
+			call.Seq, call.Metadata, call.Trailer = sent.Seq,sent.Metadata,sent.Trailer
+			return sent.Error
+		})(context.Background(),serviceMethod,args,reply)
+		call.done()
+	}()
+	return call
+}
+
+// Go with the outgoing metadata of ctx attached to the request
+func(client *Client)goContext(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *Call)*Call{
 	if done == nil{
 		done = make(chan *Call,10)
 	}else if cap(done) == 0{
 		log.Panic("rpc client: done channl is unbuffered")
 	}
 
+	md, _ := OutgoingMetadata(ctx)
+	deadline, _ := ctx.Deadline()
 	call := &Call{
 		ServiceMethod: serviceMethod,
 		Args: args,
 		Reply: reply,
 		Done: done,
+		Metadata: md,
+		deadline: deadline,
 	}
 	
 	client.send(call)
 	return call
 }
 
+// Notify calls a method without waiting for a reply, the server runs it and sends nothing back.
+// no call is kept pending, an error only means the notification could not be sent
+func(client *Client)Notify(serviceMethod string, args interface{})error{
+	client.mu.Lock()
+	err := client.usable()
+	client.mu.Unlock()
+	if err != nil{
+		return err
+	}
+	return client.write(&codec.Header{ServiceMethod: serviceMethod,Kind: codec.KindNotify},args)
+}
+
 func(client *Client)Call(ctx context.Context,serviceMethod string, args, reply interface{})error{
+	return client.intercept(client.call)(ctx,serviceMethod,args,reply)
+}
+
+// the call itself, after all interceptors ran
+func(client *Client)call(ctx context.Context,serviceMethod string, args, reply interface{})error{
 	// user can use context withtime out to add timeout during call
-	call := client.Go(serviceMethod,args,reply,make(chan *Call,1))
+	return client.wait(ctx,client.goContext(ctx,serviceMethod,args,reply,make(chan *Call,1)))
+}
+
+// wait for a sent call, telling the server when ctx is done first
+func(client *Client)wait(ctx context.Context, call *Call)error{
 	select{
 	case <-ctx.Done():
-		client.removeCall(call.Seq)
-		return errors.New("rpc client:call failed:"+ctx.Err().Error())
+		// only a call still pending was sent and not answered yet
+		if client.removeCall(call.Seq) != nil{
+			client.sendCancel(call.Seq)
+		}
+		return Errorf(CodeOf(ctx.Err()),"rpc client:call failed:%v",ctx.Err())
 	case call:= <-call.Done:
+		if sink, ok := ctx.Value(trailerSinkKey{}).(*Metadata);ok && sink != nil{
+			*sink = call.Trailer
+		}
 		return call.Error
 	}
 }
@@ -234,12 +375,12 @@ func dialTimeout(f newClientFunc, network,address string, opts ...*Option)(clien
 	// not timeout
 	if opt.ConnectTimeout == 0{
 		result := <-ch
-		return result.client,err
+		return result.client,result.err
 	}
 	// check weather timeout reach first or result reach first
 	select{
 	case <- time.After(opt.ConnectTimeout):
-		return nil, fmt.Errorf("rpc client:connect timeout:expect within %s",opt.ConnectTimeout)
+		return nil, Errorf(DeadlineExceeded,"rpc client:connect timeout:expect within %s",opt.ConnectTimeout)
 	case result := <-ch:
 		return result.client,result.err
 	}
@@ -273,6 +414,12 @@ func XDial(rpcAddr string, opts ...*Option)(*Client,error){
 	switch protocol{
 	case "http":
 		return DialHTTP("tcp",addr,opts...)
+	case "tls":
+		opt, err := parseOptions(opts...)
+		if err != nil{
+			return nil, err
+		}
+		return DialTLS("tcp",addr,opt.TLSConfig,opt)
 	default:
 		return Dial(protocol,addr,opts...)
 	}
@@ -280,30 +427,92 @@ func XDial(rpcAddr string, opts ...*Option)(*Client,error){
 
 // constructor for client
 func NewClient(conn net.Conn, opt *Option)(*Client, error){
-	// check if codec function can be found
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil{
-		err := fmt.Errorf("invalid codec type %s",opt.CodecType)
-		log.Println("rpc client:codec error:",err)
-		return nil, err
+	// every codec we offer must be available locally
+	for _, t := range opt.acceptCodecs(){
+		if _, ok := codec.Lookup(t);!ok{
+			err := fmt.Errorf("invalid codec type %s",t)
+			log.Println("rpc client:codec error:",err)
+			return nil, err
+		}
 	}
 
+	// present our credentials next to the option
+	hs := handshakeRequest{Option: opt}
+	if opt.Credentials != nil{
+		token, err := opt.Credentials.Token()
+		if err != nil{
+			_ = conn.Close()
+			return nil, Errorf(Unauthenticated,"rpc client: credentials error: %v",err)
+		}
+		hs.Token = token
+	}
 	// send opt to server to check validity.
-	if err := json.NewEncoder(conn).Encode(opt);err != nil{
+	if err := writeJSON(conn,&hs);err != nil{
 		log.Println("rpc client:options error:",err)
 		_ = conn.Close()
 		return nil, err
 	}
+	// wait for the server to pick a codec
+	var reply handshakeReply
+	if err := json.NewDecoder(conn).Decode(&reply);err != nil{
+		log.Println("rpc client:handshake error:",err)
+		_ = conn.Close()
+		return nil, err
+	}
+	if reply.Error != ""{
+		_ = conn.Close()
+		if reply.Code == OK{
+			reply.Code = Unknown
+		}
+		return nil, &Error{Code: reply.Code,Message: reply.Error}
+	}
+	f, ok := codec.Lookup(reply.CodecType)
+	if !ok || !containsCodec(opt.acceptCodecs(),reply.CodecType){
+		_ = conn.Close()
+		return nil, fmt.Errorf("rpc client: server chose codec %s which was not offered",reply.CodecType)
+	}
 	// create codec and client
-	return newClientCodec(f(conn),opt),nil
+	if reply.Framing{
+		s, ok := codec.LookupSerializer(reply.CodecType)
+		if !ok || !opt.framing(){
+			_ = conn.Close()
+			return nil, fmt.Errorf("rpc client: server framed codec %s unexpectedly",reply.CodecType)
+		}
+		fc := codec.NewFrameCodec(conn,s,opt.MaxFrameSize)
+		if reply.Compression != ""{
+			comp, ok := codec.LookupCompressor(reply.Compression)
+			if !ok || reply.Compression != opt.Compression{
+				_ = conn.Close()
+				return nil, fmt.Errorf("rpc client: server chose compression %s which was not offered",reply.Compression)
+			}
+			fc.SetCompressor(comp,opt.CompressThreshold)
+		}
+		return newClientCodec(fc,opt,reply.CodecType),nil
+	}
+	cc := f(conn)
+	if l, ok := cc.(codec.FrameLimiter);ok{
+		l.SetMaxFrameSize(opt.MaxFrameSize)
+	}
+	return newClientCodec(cc,opt,reply.CodecType),nil
+}
+
+func containsCodec(types []codec.Type, t codec.Type)bool{
+	for _, c := range types{
+		if c == t{
+			return true
+		}
+	}
+	return false
 }
 
-func newClientCodec(cc codec.Codec,opt *Option)*Client{
+func newClientCodec(cc codec.Codec,opt *Option, t codec.Type)*Client{
 	client := &Client{
 		seq: 1,
 		cc: cc,
 		opt: opt,
+		codecType: t,
 		pending: make(map[uint64]*Call),
+		callbacks: NewServer(),
 	}
 	// start reciveing response
 	go client.receive()
@@ -1,10 +1,14 @@
 package gorpc
 
 import (
+	"context"
+	"encoding/json"
+	"gorpc/codec"
 	"net"
 	"os"
 	"runtime"
 	"testing"
+	"time"
 )
 func TestXDial(t *testing.T) {
 	if runtime.GOOS == "linux"{
@@ -14,7 +18,9 @@ func TestXDial(t *testing.T) {
 			_ = os.Remove(addr)
 			l,err := net.Listen("unix",addr)
 			if err != nil{
-				t.Fatal("failed to listen unix socket")
+				t.Error("failed to listen unix socket")
+				close(ch)
+				return
 			}
 			ch <-struct{}{}
 			Accept(l)
@@ -23,4 +29,139 @@ func TestXDial(t *testing.T) {
 		_,err := XDial("unix@"+addr)
 		_assert(err == nil, "failed to connect unix socket")
 	}
-}
\ No newline at end of file
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	l, _ := net.Listen("tcp", ":0")
+	go NewServer().Accept(l)
+	addr := l.Addr().String()
+
+	// server should pick the first codec in client's list
+	client, err := Dial("tcp", addr, &Option{AcceptCodecs: []codec.Type{codec.JsonType, codec.GobType}})
+	_assert(err == nil, "failed to dial: %v", err)
+	_, ok := client.cc.(*codec.JsonCodec)
+	_assert(ok, "expect json codec, got %T", client.cc)
+	_ = client.Close()
+
+	// gob stays the default
+	client, err = Dial("tcp", addr)
+	_assert(err == nil, "failed to dial: %v", err)
+	_, ok = client.cc.(*codec.GobCodec)
+	_assert(ok, "expect gob codec, got %T", client.cc)
+	_ = client.Close()
+}
+
+func TestCodecNegotiationRejected(t *testing.T) {
+	cli, srv := net.Pipe()
+	go NewServer().ServeConn(srv)
+	defer func() { _ = cli.Close() }()
+
+	opt := &Option{MagicNumber: MagicNumber, AcceptCodecs: []codec.Type{"application/unknown"}}
+	_assert(writeJSON(cli, opt) == nil, "failed to write option")
+	var reply handshakeReply
+	_assert(json.NewDecoder(cli).Decode(&reply) == nil, "failed to read handshake reply")
+	_assert(reply.Error != "" && reply.CodecType == "", "expect codec to be rejected, got %+v", reply)
+}
+
+func TestClientInterceptors(t *testing.T) {
+	server := NewServer()
+	var tenant Tenant
+	_ = server.Register(&tenant)
+	var seen []string
+	opt := &Option{Interceptors: []ClientInterceptor{
+		func(ctx context.Context, serviceMethod string, args, reply interface{}, invoke Invoker) error {
+			seen = append(seen, serviceMethod)
+			// inject metadata for every call
+			return invoke(NewOutgoingContext(ctx, Metadata{"tenant": "t9"}), serviceMethod, args, reply)
+		},
+		func(ctx context.Context, serviceMethod string, args, reply interface{}, invoke Invoker) error {
+			err := invoke(ctx, serviceMethod, args, reply)
+			if CodeOf(err) == Unknown {
+				err = Errorf(Internal, "wrapped: %v", err)
+			}
+			return err
+		},
+	}}
+	client := newPipeClient(t, server, opt)
+
+	var reply string
+	err := client.Call(context.Background(), "Tenant.Check", Args{}, &reply)
+	_assert(err == nil && reply == "tenant t9", "expect metadata to reach handler, got %q, %v", reply, err)
+
+	call := <-client.Go("Tenant.Fail", Args{}, &reply, nil).Done
+	_assert(CodeOf(call.Error) == Internal && call.Error.Error() == "wrapped: 100% plain", "unexpected error %v", call.Error)
+	_assert(len(seen) == 2, "expect both calls to be intercepted, got %v", seen)
+}
+
+// Audit records the events it is told about
+type Audit chan Args
+
+func (a Audit) Record(args Args, reply *int) error {
+	a <- args
+	return nil
+}
+
+func TestNotify(t *testing.T) {
+	server := NewServer()
+	audit := make(Audit, 10)
+	var tenant Tenant
+	_ = server.Register(audit)
+	_ = server.Register(&tenant)
+	client := newPipeClient(t, server, nil)
+
+	for i := 0; i < 3; i++ {
+		_assert(client.Notify("Audit.Record", Args{Num1: i}) == nil, "failed to notify")
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-audit:
+		case <-time.After(time.Second):
+			t.Fatal("notification did not reach the handler")
+		}
+	}
+	client.mu.Lock()
+	pending := len(client.pending)
+	client.mu.Unlock()
+	_assert(pending == 0, "expect no pending calls, got %d", pending)
+
+	// nothing comes back for notifications, whatever happens to them
+	conn, cc := newRawConn(t, server, 0)
+	for _, method := range []string{"Audit.Record", "Audit.Unknown", "Tenant.Fail", "Tenant.Panic"} {
+		_assert(cc.Write(&codec.Header{ServiceMethod: method, Kind: codec.KindNotify}, Args{}) == nil, "failed to notify %s", method)
+	}
+	_assert(cc.Write(&codec.Header{ServiceMethod: "Audit.Record", Seq: 1}, Args{}) == nil, "failed to call")
+	expectOneResponse(t, conn, cc, 1, 300*time.Millisecond)
+
+	_ = client.Close()
+	_assert(client.Notify("Audit.Record", Args{}) == ErrShutdown, "expect notify on a closed client to fail")
+}
+
+func TestConnectionLost(t *testing.T) {
+	server := NewServer()
+	w := make(Waiter, 1)
+	logs := make(Logs, 1)
+	_ = server.Register(w)
+	_ = server.Register(logs)
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	client, err := NewClient(cli, DefaultOption)
+	_assert(err == nil, "failed to create client: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	call := client.Go("Waiter.Wait", Args{}, &reply, nil)
+	stream := client.Stream(context.Background(), "Logs.Follow", Args{}, new(Line))
+	_assert(stream.Next(), "expect a line, got %v", stream.Err())
+	time.Sleep(50 * time.Millisecond)
+	_ = srv.Close()
+
+	select {
+	case call = <-call.Done:
+		_assert(CodeOf(call.Error) == Unavailable, "expect Unavailable, got %v", call.Error)
+	case <-time.After(time.Second):
+		t.Fatal("call not failed after the connection was lost")
+	}
+	for stream.Next() {
+	}
+	_assert(CodeOf(stream.Err()) == Unavailable, "expect stream to fail with Unavailable, got %v", stream.Err())
+}
@@ -0,0 +1,83 @@
+package codec
+
+import "encoding/binary"
+
+// BatchItem is one request of a batch, or its result. Body holds the arguments or the reply,
+// encoded on their own with the Serializer of the connection's codec
+type BatchItem struct{
+	ServiceMethod string
+	Error string
+	Code uint32 // status code of a failed item, see gorpc.Code
+	Details map[string]string
+	Body []byte
+}
+
+// Batch is the body of a KindBatch request and of its response
+type Batch struct{
+	Ordered bool // run the requests one after another, in order, instead of concurrently
+	Items []BatchItem
+}
+
+// batch schema:
+//   bool ordered = 1;
+//   repeated Item items = 2;
+// item schema:
+//   string service_method = 1;
+//   string error = 2;
+//   uint32 code = 3;
+//   map<string, string> details = 4;
+//   bytes body = 5;
+func (b *Batch)Marshal()([]byte,error){
+	var data []byte
+	if b.Ordered{
+		data = appendProtoUint(data,1,1)
+	}
+	for i := range b.Items{
+		item := &b.Items[i]
+		var p []byte
+		p = appendProtoString(p,1,item.ServiceMethod)
+		p = appendProtoString(p,2,item.Error)
+		p = appendProtoUint(p,3,uint64(item.Code))
+		p = appendProtoMap(p,4,item.Details)
+		p = appendProtoString(p,5,string(item.Body))
+		// repeated messages are written even when empty, every item counts
+		data = binary.AppendUvarint(appendProtoTag(data,2,wireBytes),uint64(len(p)))
+		data = append(data,p...)
+	}
+	return data,nil
+}
+
+func (b *Batch)Unmarshal(data []byte)error{
+	*b = Batch{}
+	return walkProtoFields(data,func(field int, wire int, u uint64, p []byte)error{
+		switch{
+		case field == 1 && wire == wireVarint:
+			b.Ordered = u != 0
+		case field == 2 && wire == wireBytes:
+			var item BatchItem
+			err := walkProtoFields(p,func(field int, wire int, u uint64, p []byte)error{
+				switch{
+				case field == 1 && wire == wireBytes:
+					item.ServiceMethod = string(p)
+				case field == 2 && wire == wireBytes:
+					item.Error = string(p)
+				case field == 3 && wire == wireVarint:
+					item.Code = uint32(u)
+				case field == 4 && wire == wireBytes:
+					if item.Details == nil{
+						item.Details = make(map[string]string)
+					}
+					return parseProtoMapEntry(p,item.Details)
+				case field == 5 && wire == wireBytes:
+					item.Body = append([]byte(nil),p...)
+				}
+				return nil
+			})
+			if err != nil{
+				return err
+			}
+			b.Items = append(b.Items,item)
+		}
+		return nil
+	})
+}
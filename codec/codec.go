@@ -1,12 +1,42 @@
 package codec
 
-import "io"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Kind tells what a message is for, the zero value is an ordinary request or its response
+type Kind uint8
+
+const(
+	KindCall Kind = iota
+	KindCancel // client gave up on the call with the same Seq
+	KindGoAway // server is shutting down, client should not send new requests
+	KindStream // request opening a stream, answered by stream messages and then an ordinary response
+	KindStreamMsg // one message of the stream with the same Seq
+	KindClientStream // request opening a stream the client sends messages on as well, its body is empty
+	KindStreamEnd // client sends no more messages on the stream with the same Seq
+	KindWindowUpdate // the receiver of a stream is ready for Window more messages
+	KindNotify // request that is never answered, its Seq means nothing
+	KindCallback // request from the server to a method the client registered, Seq is the server's own
+	KindCallbackReply // client's response to the callback with the same Seq
+	KindBatch // request carrying several calls in a Batch body, answered by an ordinary response with a Batch body
+)
 
 // we define a header
 type Header struct{
 	ServiceMethod string // format  "Service.Method"
 	Seq uint64 // sequence number chosen by client
 	Error string
+	Metadata map[string]string // request metadata, or trailing metadata on a response
+	Code uint32 // status code of a failed call, see gorpc.Code
+	Details map[string]string // structured details of a failed call
+	Kind Kind
+	Timeout int64 // nanoseconds the caller still waits as the message is sent, 0 means no deadline
+	Window uint32 // flow control credit, in stream messages
 }
 // Codec interface 
 type Codec interface{
@@ -21,18 +51,101 @@ type NewCodecFunc func(io.ReadWriteCloser)Codec
 
 type Type string
 
-// currently we only support gob, json
+// currently we support gob, json, msgpack and protobuf
 const(
 	GobType Type = "application/gob"
-	JsonTYpe Type = "application/json"
+	JsonType Type = "application/json"
+	MsgpackType Type = "application/msgpack"
+	ProtobufType Type = "application/protobuf"
+	// Deprecated: use JsonType
+	JsonTYpe = JsonType
 )
 
-var NewCodecFuncMap map[Type]NewCodecFunc
+var (
+	ErrCodecExists = errors.New("codec: codec type already registered")
+	ErrInvalidCodec = errors.New("codec: codec type must be non-empty and constructor non-nil")
+)
 
-func init(){
-	NewCodecFuncMap = make(map[Type]NewCodecFunc)
-	NewCodecFuncMap[GobType] = NewGobCodec
+// registered codecs and serializers, guarded by mu so codecs can be registered while serving
+var (
+	mu sync.RWMutex
+	newCodecFuncMap = make(map[Type]NewCodecFunc)
+	serializerMap = make(map[Type]Serializer)
+)
+
+// NewCodecFuncMap is the registry itself, so code written before Register keeps seeing every codec.
+//
+// Deprecated: use Register, Lookup and Registered. the map is not guarded, reading or
+// writing it while codecs are registered or looked up is a data race
+var NewCodecFuncMap = newCodecFuncMap
+
+// Register makes a codec available to clients and servers under name t.
+// registering the same type twice is an error, so built-in codecs cannot be overwritten
+func Register(t Type, f NewCodecFunc)error{
+	if t == "" || f == nil{
+		return ErrInvalidCodec
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := newCodecFuncMap[t];dup{
+		return fmt.Errorf("%w: %s",ErrCodecExists,t)
+	}
+	newCodecFuncMap[t] = f
+	return nil
 }
 
+// Lookup returns the constructor registered for t
+func Lookup(t Type)(NewCodecFunc,bool){
+	mu.RLock()
+	defer mu.RUnlock()
+	f, ok := newCodecFuncMap[t]
+	return f,ok
+}
 
+// Registered returns all registered codec types in sorted order
+func Registered()[]Type{
+	mu.RLock()
+	defer mu.RUnlock()
+	types := make([]Type,0,len(newCodecFuncMap))
+	for t := range newCodecFuncMap{
+		types = append(types, t)
+	}
+	sort.Slice(types,func(i, j int)bool{return types[i] < types[j]})
+	return types
+}
+
+// RegisterSerializer lets codec type t run on top of the framing layer.
+// the serializer must produce the same encoding as the codec registered for t
+func RegisterSerializer(t Type, s Serializer)error{
+	if t == "" || s == nil{
+		return ErrInvalidCodec
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := serializerMap[t];dup{
+		return fmt.Errorf("%w: serializer %s",ErrCodecExists,t)
+	}
+	serializerMap[t] = s
+	return nil
+}
 
+// LookupSerializer returns the serializer registered for t
+func LookupSerializer(t Type)(Serializer,bool){
+	mu.RLock()
+	defer mu.RUnlock()
+	s, ok := serializerMap[t]
+	return s,ok
+}
+
+func init(){
+	_ = Register(GobType,NewGobCodec)
+	_ = Register(JsonType,NewJsonCodec)
+	_ = Register(MsgpackType,NewMsgpackCodec)
+	_ = Register(ProtobufType,NewProtobufCodec)
+	_ = RegisterSerializer(GobType,GobSerializer{})
+	_ = RegisterSerializer(JsonType,JsonSerializer{})
+	_ = RegisterSerializer(MsgpackType,MsgpackSerializer{})
+	_ = RegisterSerializer(ProtobufType,ProtobufSerializer{})
+	_ = RegisterCompressor("gzip",GzipCompressor{})
+	_ = RegisterCompressor("deflate",DeflateCompressor{})
+}
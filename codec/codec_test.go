@@ -0,0 +1,283 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	// built-in codecs cannot be overwritten
+	if err := Register(GobType, NewJsonCodec); !errors.Is(err, ErrCodecExists) {
+		t.Fatalf("expect ErrCodecExists, got %v", err)
+	}
+	if err := Register("", NewGobCodec); err != ErrInvalidCodec {
+		t.Fatalf("expect ErrInvalidCodec for empty type, got %v", err)
+	}
+	if err := Register("application/x-test", nil); err != ErrInvalidCodec {
+		t.Fatalf("expect ErrInvalidCodec for nil constructor, got %v", err)
+	}
+
+	custom := Type("application/x-test")
+	if err := Register(custom, func(conn io.ReadWriteCloser) Codec { return NewJsonCodec(conn) }); err != nil {
+		t.Fatalf("failed to register codec: %v", err)
+	}
+	// the registry is global, leave it as it was so the test can run again
+	t.Cleanup(func() {
+		mu.Lock()
+		delete(newCodecFuncMap, custom)
+		mu.Unlock()
+	})
+	if _, ok := Lookup(custom); !ok {
+		t.Fatal("registered codec not found")
+	}
+	if NewCodecFuncMap[custom] == nil || NewCodecFuncMap[GobType] == nil {
+		t.Fatal("expect the deprecated map to show registered codecs")
+	}
+	found := false
+	for _, typ := range Registered() {
+		found = found || typ == custom
+	}
+	if !found {
+		t.Fatalf("expect %s in %v", custom, Registered())
+	}
+}
+
+type msgpackInner struct {
+	Tags  []string
+	Score float64
+}
+
+type msgpackSample struct {
+	Name    string
+	Count   int
+	Neg     int64
+	Big     uint64
+	OK      bool
+	Data    []byte
+	Inner   *msgpackInner
+	Attrs   map[string]int
+	Renamed string `msgpack:"renamed"`
+	Skipped string `msgpack:"-"`
+	Any     interface{}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	in := msgpackSample{
+		Name:    "gorpc",
+		Count:   300,
+		Neg:     -70000,
+		Big:     1 << 40,
+		OK:      true,
+		Data:    []byte{1, 2, 3},
+		Inner:   &msgpackInner{Tags: []string{"a", "b"}, Score: 0.5},
+		Attrs:   map[string]int{"x": -1},
+		Renamed: "r",
+		Skipped: "s",
+		Any:     "str",
+	}
+	data, err := MsgpackSerializer{}.Marshal(&in)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	var out msgpackSample
+	if err := (MsgpackSerializer{}).Unmarshal(data, &out); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	in.Skipped = ""
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip mismatch:\n%+v\n%+v", in, out)
+	}
+
+	// values can be skipped when the target is nil
+	if err := (MsgpackSerializer{}).Unmarshal(data, nil); err != nil {
+		t.Fatalf("failed to skip value: %v", err)
+	}
+	// fixed encodings other implementations rely on
+	data, _ = MsgpackSerializer{}.Marshal(map[string]int{"a": 1})
+	if !bytes.Equal(data, []byte{0x81, 0xa1, 'a', 0x01}) {
+		t.Fatalf("unexpected map encoding % x", data)
+	}
+}
+
+func TestMsgpackHostileLengths(t *testing.T) {
+	inputs := map[string][]byte{
+		"array32 in a map": {0x81, 0xa1, 'X', 0xdd, 0xff, 0xff, 0xff, 0xff},
+		"str32":            {0xdb, 0xff, 0xff, 0xff, 0xff},
+		"bin32":            {0xc6, 0x7f, 0xff, 0xff, 0xff, 0x00},
+		"map32":            {0xdf, 0xff, 0xff, 0xff, 0xff},
+		"array16":          {0xdc, 0x01, 0x00, 0x01},
+	}
+	deep := append(bytes.Repeat([]byte{0x91}, 2*msgpackMaxDepth), 0xc0)
+	var v interface{}
+	if err := (MsgpackSerializer{}).Unmarshal(deep, &v); !errors.Is(err, errMsgpackDepth) {
+		t.Fatalf("expect errMsgpackDepth for deep nesting, got %v", err)
+	}
+	var nested []interface{}
+	if err := (MsgpackSerializer{}).Unmarshal(deep, &nested); !errors.Is(err, errMsgpackDepth) {
+		t.Fatalf("expect errMsgpackDepth for deep nesting into a slice, got %v", err)
+	}
+
+	for name, data := range inputs {
+		var v interface{}
+		if err := (MsgpackSerializer{}).Unmarshal(data, &v); !errors.Is(err, errMsgpackLength) {
+			t.Errorf("%s: expect errMsgpackLength, got %v", name, err)
+		}
+		var m map[string][]int
+		if err := (MsgpackSerializer{}).Unmarshal(data, &m); err == nil {
+			t.Errorf("%s: expect typed decode to fail", name)
+		}
+	}
+
+	// a stream has no end to measure against, a message may not outgrow the limit
+	var b bytes.Buffer
+	b.Write(inputs["array32 in a map"])
+	c := NewMsgpackCodec(pipeConn{&b, &b}).(*MsgpackCodec)
+	c.SetMaxFrameSize(1024)
+	if err := c.ReadBody(nil); !errors.Is(err, errMsgpackLength) {
+		t.Fatalf("expect errMsgpackLength on a stream, got %v", err)
+	}
+
+	// skipped fields count too, two unknown fields of 42 bytes outgrow a limit of 64 together
+	b.Reset()
+	b.Write([]byte{0x82})
+	for _, name := range []byte{'a', 'b'} {
+		b.Write([]byte{0xa1, name, 0xd9, 40})
+		b.Write(bytes.Repeat([]byte{'x'}, 40))
+	}
+	c.SetMaxFrameSize(64)
+	var inner msgpackInner
+	if err := c.ReadBody(&inner); !errors.Is(err, errMsgpackLength) {
+		t.Fatalf("expect skipped fields to count against the limit, got %v", err)
+	}
+}
+
+// hand written stand-in for a generated message: string name = 1;
+type protoName struct {
+	Name string
+}
+
+func (m *protoName) Marshal() ([]byte, error) {
+	return appendProtoString(nil, 1, m.Name), nil
+}
+
+func (m *protoName) Unmarshal(data []byte) error {
+	return walkProtoFields(data, func(field int, wire int, u uint64, p []byte) error {
+		if field == 1 && wire == wireBytes {
+			m.Name = string(p)
+		}
+		return nil
+	})
+}
+
+func (m *protoName) Reset() { *m = protoName{} }
+
+type pipeConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (pipeConn) Close() error { return nil }
+
+func TestProtobufCodec(t *testing.T) {
+	var b bytes.Buffer
+	c := NewProtobufCodec(pipeConn{&b, &b})
+	h := &Header{ServiceMethod: "Svc.Method", Seq: 7, Error: "oops", Metadata: map[string]string{"tenant": "t1", "empty": ""},
+		Code: 5, Details: map[string]string{"field": "name"}, Kind: KindWindowUpdate, Timeout: 1 << 60, Window: 64}
+	// values are accepted when their pointer implements ProtoMessage
+	if err := c.Write(h, protoName{Name: "gorpc"}); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := c.Write(h, struct{}{}); err != nil {
+		t.Fatalf("failed to write empty body: %v", err)
+	}
+
+	var got Header
+	var body protoName
+	if err := c.ReadHeader(&got); err != nil || !reflect.DeepEqual(got, *h) {
+		t.Fatalf("header mismatch: %+v, %v", got, err)
+	}
+	if err := c.ReadBody(&body); err != nil || body.Name != "gorpc" {
+		t.Fatalf("body mismatch: %+v, %v", body, err)
+	}
+	if err := c.ReadHeader(&got); err != nil {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	if err := c.ReadBody(nil); err != nil {
+		t.Fatalf("failed to drop body: %v", err)
+	}
+
+	if _, err := (ProtobufSerializer{}).Marshal(42); !errors.Is(err, errNotProtoMessage) {
+		t.Fatalf("expect errNotProtoMessage, got %v", err)
+	}
+}
+
+func TestProtobufFrameLimit(t *testing.T) {
+	var b bytes.Buffer
+	w := NewProtobufCodec(pipeConn{&b, &b})
+	r := NewProtobufCodec(pipeConn{&b, &b}).(*ProtobufCodec)
+	r.SetMaxFrameSize(16)
+	if err := w.Write(&Header{ServiceMethod: "Service.LongMethodName"}, struct{}{}); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	var h Header
+	if err := r.ReadHeader(&h); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expect ErrFrameTooLarge reading over the limit, got %v", err)
+	}
+
+	// writing over the limit leaves nothing on the wire
+	b.Reset()
+	if err := r.Write(&Header{ServiceMethod: "Service.LongMethodName"}, struct{}{}); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expect ErrFrameTooLarge writing over the limit, got %v", err)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("expect nothing written, got %d bytes", b.Len())
+	}
+}
+
+func TestProtobufBatch(t *testing.T) {
+	b := &Batch{Ordered: true, Items: []BatchItem{
+		{ServiceMethod: "Foo.Sum", Body: []byte{1, 2, 3}},
+		{}, // empty items keep their place
+		{ServiceMethod: "Foo.Fail", Error: "gone", Code: 5, Details: map[string]string{"tenant": "t1"}},
+	}}
+	data, err := b.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	var got Batch
+	if err := protoUnmarshal(data, &got); err != nil || !reflect.DeepEqual(got, *b) {
+		t.Fatalf("batch mismatch: %+v, %v", got, err)
+	}
+}
+
+func TestFrameCompression(t *testing.T) {
+	for _, name := range []string{"gzip", "deflate"} {
+		comp, ok := LookupCompressor(name)
+		if !ok {
+			t.Fatalf("compressor %s not registered", name)
+		}
+		var b bytes.Buffer
+		c := NewFrameCodec(pipeConn{&b, &b}, JsonSerializer{}, 0)
+		c.SetCompressor(comp, 64)
+
+		body := strings.Repeat("gorpc ", 1000)
+		if err := c.Write(&Header{ServiceMethod: "Svc.Method", Seq: 1}, body); err != nil {
+			t.Fatalf("%s: failed to write: %v", name, err)
+		}
+		if b.Len() >= len(body) {
+			t.Fatalf("%s: expect payload to shrink, wrote %d bytes", name, b.Len())
+		}
+		var h Header
+		var got string
+		if err := c.ReadHeader(&h); err != nil || h.Seq != 1 {
+			t.Fatalf("%s: header mismatch: %+v, %v", name, h, err)
+		}
+		if err := c.ReadBody(&got); err != nil || got != body {
+			t.Fatalf("%s: body mismatch: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compressor compresses frame payloads. register one under a name with RegisterCompressor,
+// clients pick it through the Compression field of their option
+type Compressor interface{
+	Compress(data []byte)([]byte,error)
+	// Decompress must fail instead of producing more than limit bytes
+	Decompress(data []byte, limit int)([]byte,error)
+}
+
+// payloads smaller than this are not worth compressing
+const DefaultCompressThreshold = 1024
+
+var compressorMap = make(map[string]Compressor)
+
+// RegisterCompressor makes a compressor available under name, names cannot be registered twice
+func RegisterCompressor(name string, c Compressor)error{
+	if name == "" || c == nil{
+		return ErrInvalidCodec
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := compressorMap[name];dup{
+		return fmt.Errorf("%w: compressor %s",ErrCodecExists,name)
+	}
+	compressorMap[name] = c
+	return nil
+}
+
+// LookupCompressor returns the compressor registered under name
+func LookupCompressor(name string)(Compressor,bool){
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := compressorMap[name]
+	return c,ok
+}
+
+// read everything from r, failing once more than limit bytes come out
+func readLimited(r io.Reader, limit int)([]byte,error){
+	data, err := io.ReadAll(io.LimitReader(r,int64(limit)+1))
+	if err != nil{
+		return nil, err
+	}
+	if len(data) > limit{
+		return nil, fmt.Errorf("%w: decompressed payload over %d",ErrFrameTooLarge,limit)
+	}
+	return data,nil
+}
+
+// GzipCompressor uses compress/gzip
+type GzipCompressor struct{}
+
+func (GzipCompressor)Compress(data []byte)([]byte,error){
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data);err != nil{
+		return nil, err
+	}
+	if err := w.Close();err != nil{
+		return nil, err
+	}
+	return b.Bytes(),nil
+}
+
+func (GzipCompressor)Decompress(data []byte, limit int)([]byte,error){
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil{
+		return nil, err
+	}
+	defer func(){_ = r.Close()}()
+	return readLimited(r,limit)
+}
+
+// DeflateCompressor uses raw compress/flate, it is a bit smaller than gzip on the wire
+type DeflateCompressor struct{}
+
+func (DeflateCompressor)Compress(data []byte)([]byte,error){
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b,flate.DefaultCompression)
+	if err != nil{
+		return nil, err
+	}
+	if _, err := w.Write(data);err != nil{
+		return nil, err
+	}
+	if err := w.Close();err != nil{
+		return nil, err
+	}
+	return b.Bytes(),nil
+}
+
+func (DeflateCompressor)Decompress(data []byte, limit int)([]byte,error){
+	r := flate.NewReader(bytes.NewReader(data))
+	defer func(){_ = r.Close()}()
+	return readLimited(r,limit)
+}
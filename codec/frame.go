@@ -0,0 +1,186 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// every frame starts with a 4 byte big endian payload length and a flag byte,
+// the payload follows
+const frameHeaderSize = 5
+
+// frame flags
+const (
+	frameCompressed = 1 << iota // payload went through the connection's compressor
+)
+
+// largest payload accepted when the caller does not set a limit
+const DefaultMaxFrameSize = 16 << 20
+
+var ErrFrameTooLarge = errors.New("codec: frame exceeds size limit")
+
+// FrameLimiter is implemented by codecs that bound the size of every message they read and write
+// on their own, without the framing layer. NewFrameCodec takes its limit directly
+type FrameLimiter interface{
+	SetMaxFrameSize(n int)
+}
+
+// Serializer encodes a single value into a self-contained byte slice.
+// codecs backed by a serializer can run on top of the framing layer
+type Serializer interface{
+	Marshal(v interface{})([]byte,error)
+	Unmarshal(data []byte, v interface{})error
+}
+
+// FrameCodec wraps every header and body into its own length-prefixed frame.
+// a body that cannot be decoded is consumed completely, so the stream stays aligned
+type FrameCodec struct{
+	conn io.ReadWriteCloser
+	r *bufio.Reader
+	buf *bufio.Writer
+	s Serializer
+	maxFrameSize int
+	comp Compressor // nil when the connection is not compressed
+	threshold int // payloads below this size are sent as is
+}
+
+var _ Codec = (*FrameCodec)(nil)
+
+// create a framed codec, maxFrameSize <= 0 means DefaultMaxFrameSize
+func NewFrameCodec(conn io.ReadWriteCloser, s Serializer, maxFrameSize int)*FrameCodec{
+	if maxFrameSize <= 0{
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	return &FrameCodec{
+		conn: conn,
+		r: bufio.NewReader(conn),
+		buf: bufio.NewWriter(conn),
+		s: s,
+		maxFrameSize: maxFrameSize,
+	}
+}
+
+// compress outgoing payloads of at least threshold bytes with comp,
+// threshold <= 0 means DefaultCompressThreshold. set it before the codec is used
+func (c *FrameCodec)SetCompressor(comp Compressor, threshold int){
+	if threshold <= 0{
+		threshold = DefaultCompressThreshold
+	}
+	c.comp, c.threshold = comp,threshold
+}
+
+// read next frame. a frame over the limit is reported as ErrFrameTooLarge and closes the connection,
+// reading on could mean draining gigabytes from a hostile peer
+func (c *FrameCodec)readFrame()([]byte,error){
+	var hdr [frameHeaderSize]byte
+	if _, err := io.ReadFull(c.r,hdr[:]);err != nil{
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if uint64(n) > uint64(c.maxFrameSize){
+		_ = c.Close()
+		return nil, fmt.Errorf("%w: %d > %d",ErrFrameTooLarge,n,c.maxFrameSize)
+	}
+	data := make([]byte,n)
+	if _, err := io.ReadFull(c.r,data);err != nil{
+		if err == io.EOF{
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	switch hdr[4]{
+	case 0:
+		return data,nil
+	case frameCompressed:
+		if c.comp == nil{
+			return nil, errors.New("codec: compressed frame on uncompressed connection")
+		}
+		return c.comp.Decompress(data,c.maxFrameSize)
+	default:
+		return nil, fmt.Errorf("codec: unknown frame flags %#x",hdr[4])
+	}
+}
+
+func (c *FrameCodec)checkFrameSize(data []byte)error{
+	if len(data) > c.maxFrameSize{
+		return fmt.Errorf("%w: %d > %d",ErrFrameTooLarge,len(data),c.maxFrameSize)
+	}
+	return nil
+}
+
+func (c *FrameCodec)writeFrame(data []byte)error{
+	var hdr [frameHeaderSize]byte
+	if c.comp != nil && len(data) >= c.threshold{
+		compressed, err := c.comp.Compress(data)
+		if err != nil{
+			return err
+		}
+		// only worth it when the payload actually shrinks
+		if len(compressed) < len(data){
+			data = compressed
+			hdr[4] |= frameCompressed
+		}
+	}
+	binary.BigEndian.PutUint32(hdr[:4],uint32(len(data)))
+	if _, err := c.buf.Write(hdr[:]);err != nil{
+		return err
+	}
+	_, err := c.buf.Write(data)
+	return err
+}
+
+func (c *FrameCodec)ReadHeader(h *Header)error{
+	data, err := c.readFrame()
+	if err != nil{
+		return err
+	}
+	return c.s.Unmarshal(data,h)
+}
+
+// a nil body just drops the frame
+func (c *FrameCodec)ReadBody(body interface{})error{
+	data, err := c.readFrame()
+	if err != nil || body == nil{
+		return err
+	}
+	return c.s.Unmarshal(data,body)
+}
+
+func (c *FrameCodec)Write(h *Header, body interface{})(err error){
+	// encode and check both parts first, so a bad body never leaves half a message on the wire
+	hdata, err := c.s.Marshal(h)
+	if err != nil{
+		log.Println("rpc codec: frame error encoding header:",err)
+		return err
+	}
+	bdata, err := c.s.Marshal(body)
+	if err != nil{
+		log.Println("rpc codec: frame error encoding body:",err)
+		return err
+	}
+	if err := c.checkFrameSize(hdata);err != nil{
+		return err
+	}
+	if err := c.checkFrameSize(bdata);err != nil{
+		return err
+	}
+
+	defer func(){
+		_ = c.buf.Flush()
+		if err != nil{
+			_ = c.Close()
+		}
+	}()
+	if err = c.writeFrame(hdata);err != nil{
+		return err
+	}
+	return c.writeFrame(bdata)
+}
+
+func (c *FrameCodec)Close()error{
+	return c.conn.Close()
+}
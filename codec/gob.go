@@ -2,6 +2,7 @@ package codec
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/gob"
 	"io"
 	"log"
@@ -57,4 +58,20 @@ func (c *GobCodec)Write(h *Header,body interface{})(err error){
 
 func (c *GobCodec)Close()error{
 	return c.conn.Close()
-}
\ No newline at end of file
+}
+
+// GobSerializer encodes every value with its own gob stream,
+// so each frame carries its type information and can be decoded on its own
+type GobSerializer struct{}
+
+func (GobSerializer)Marshal(v interface{})([]byte,error){
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v);err != nil{
+		return nil, err
+	}
+	return b.Bytes(),nil
+}
+
+func (GobSerializer)Unmarshal(data []byte, v interface{})error{
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -31,6 +31,11 @@ func (c *JsonCodec)ReadHeader(h *Header)error{
 }
 
 func (c *JsonCodec)ReadBody(body interface{})error{
+	// json cannot decode into nil, so we read the value and drop it
+	if body == nil{
+		var discard json.RawMessage
+		return c.dec.Decode(&discard)
+	}
 	return c.dec.Decode(body)
 }
 
@@ -56,3 +61,14 @@ func (c *JsonCodec)Write(h *Header,body interface{})(err error){
 func (c *JsonCodec)Close()error{
 	return c.conn.Close()
 }
+
+// JsonSerializer encodes values with encoding/json
+type JsonSerializer struct{}
+
+func (JsonSerializer)Marshal(v interface{})([]byte,error){
+	return json.Marshal(v)
+}
+
+func (JsonSerializer)Unmarshal(data []byte, v interface{})error{
+	return json.Unmarshal(data,v)
+}
@@ -0,0 +1,78 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"reflect"
+)
+
+type MsgpackCodec struct{
+	conn io.ReadWriteCloser
+	buf *bufio.Writer
+	dec *msgpackDecoder
+}
+
+var _ Codec = (*MsgpackCodec)(nil)
+var _ FrameLimiter = (*MsgpackCodec)(nil)
+
+func NewMsgpackCodec(conn io.ReadWriteCloser)Codec{
+	return &MsgpackCodec{
+		conn: conn,
+		buf: bufio.NewWriter(conn),
+		dec: &msgpackDecoder{r: bufio.NewReader(conn),limit: DefaultMaxFrameSize},
+	}
+}
+
+// bound every header and body read to n bytes, n <= 0 means DefaultMaxFrameSize. set it before the codec is used
+func (c *MsgpackCodec)SetMaxFrameSize(n int){
+	if n <= 0{
+		n = DefaultMaxFrameSize
+	}
+	c.dec.limit = n
+}
+
+func (c *MsgpackCodec)ReadHeader(h *Header)error{
+	return c.dec.Decode(h)
+}
+
+func (c *MsgpackCodec)ReadBody(body interface{})error{
+	return c.dec.Decode(body)
+}
+
+func (c *MsgpackCodec)Write(h *Header,body interface{})(err error){
+	defer func(){
+		_ = c.buf.Flush()
+		if err != nil{
+			_ = c.Close()
+		}
+	}()
+
+	data, err := msgpackAppend(nil,reflect.ValueOf(h))
+	if err != nil{
+		log.Println("rpc codec: msgpack error encoding header:",err)
+		return err
+	}
+	if data, err = msgpackAppend(data,reflect.ValueOf(body));err != nil{
+		log.Println("rpc codec: msgpack error encoding body:",err)
+		return err
+	}
+	_, err = c.buf.Write(data)
+	return err
+}
+
+func (c *MsgpackCodec)Close()error{
+	return c.conn.Close()
+}
+
+// MsgpackSerializer lets msgpack run on top of the framing layer
+type MsgpackSerializer struct{}
+
+func (MsgpackSerializer)Marshal(v interface{})([]byte,error){
+	return msgpackAppend(nil,reflect.ValueOf(v))
+}
+
+func (MsgpackSerializer)Unmarshal(data []byte, v interface{})error{
+	return (&msgpackDecoder{r: bytes.NewReader(data),left: len(data)}).Decode(v)
+}
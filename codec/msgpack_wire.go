@@ -0,0 +1,651 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// a small reflection based msgpack encoder and decoder.
+// structs are written as maps keyed by field name, or by the `msgpack:"name"` tag,
+// so python and node consumers see plain dictionaries
+
+const (
+	mpNil = 0xc0
+	mpFalse = 0xc2
+	mpTrue = 0xc3
+	mpBin8 = 0xc4
+	mpBin16 = 0xc5
+	mpBin32 = 0xc6
+	mpFloat32 = 0xca
+	mpFloat64 = 0xcb
+	mpUint8 = 0xcc
+	mpUint16 = 0xcd
+	mpUint32 = 0xce
+	mpUint64 = 0xcf
+	mpInt8 = 0xd0
+	mpInt16 = 0xd1
+	mpInt32 = 0xd2
+	mpInt64 = 0xd3
+	mpStr8 = 0xd9
+	mpStr16 = 0xda
+	mpStr32 = 0xdb
+	mpArray16 = 0xdc
+	mpArray32 = 0xdd
+	mpMap16 = 0xde
+	mpMap32 = 0xdf
+)
+
+var errMsgpackNotPtr = errors.New("codec: msgpack decode target must be a non-nil pointer")
+
+// fields of a struct as they appear on the wire
+type msgpackField struct{
+	name string
+	index int
+}
+
+func msgpackFields(t reflect.Type)[]msgpackField{
+	fields := make([]msgpackField,0,t.NumField())
+	for i := 0;i < t.NumField();i++{
+		f := t.Field(i)
+		if f.PkgPath != ""{
+			continue // unexported
+		}
+		name := f.Name
+		if tag := f.Tag.Get("msgpack");tag != ""{
+			if tag == "-"{
+				continue
+			}
+			name = strings.Split(tag,",")[0]
+		}
+		fields = append(fields, msgpackField{name: name,index: i})
+	}
+	return fields
+}
+
+// append the msgpack encoding of v to b
+func msgpackAppend(b []byte, v reflect.Value)([]byte,error){
+	if !v.IsValid(){
+		return append(b,mpNil),nil
+	}
+	switch v.Kind(){
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil(){
+			return append(b,mpNil),nil
+		}
+		return msgpackAppend(b,v.Elem())
+	case reflect.Bool:
+		if v.Bool(){
+			return append(b,mpTrue),nil
+		}
+		return append(b,mpFalse),nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return msgpackAppendInt(b,v.Int()),nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return msgpackAppendUint(b,v.Uint()),nil
+	case reflect.Float32:
+		b = append(b,mpFloat32)
+		return binary.BigEndian.AppendUint32(b,math.Float32bits(float32(v.Float()))),nil
+	case reflect.Float64:
+		b = append(b,mpFloat64)
+		return binary.BigEndian.AppendUint64(b,math.Float64bits(v.Float())),nil
+	case reflect.String:
+		return msgpackAppendString(b,v.String()),nil
+	case reflect.Slice:
+		if v.IsNil(){
+			return append(b,mpNil),nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8{
+			return msgpackAppendBytes(b,v.Bytes()),nil
+		}
+		return msgpackAppendArray(b,v)
+	case reflect.Array:
+		return msgpackAppendArray(b,v)
+	case reflect.Map:
+		if v.IsNil(){
+			return append(b,mpNil),nil
+		}
+		b = msgpackAppendLen(b,v.Len(),0x80,mpMap16,mpMap32)
+		var err error
+		iter := v.MapRange()
+		for iter.Next(){
+			if b, err = msgpackAppend(b,iter.Key());err != nil{
+				return nil, err
+			}
+			if b, err = msgpackAppend(b,iter.Value());err != nil{
+				return nil, err
+			}
+		}
+		return b,nil
+	case reflect.Struct:
+		fields := msgpackFields(v.Type())
+		b = msgpackAppendLen(b,len(fields),0x80,mpMap16,mpMap32)
+		var err error
+		for _, f := range fields{
+			b = msgpackAppendString(b,f.name)
+			if b, err = msgpackAppend(b,v.Field(f.index));err != nil{
+				return nil, err
+			}
+		}
+		return b,nil
+	default:
+		return nil, fmt.Errorf("codec: msgpack cannot encode %s",v.Type())
+	}
+}
+
+func msgpackAppendInt(b []byte, n int64)[]byte{
+	switch{
+	case n >= 0:
+		return msgpackAppendUint(b,uint64(n))
+	case n >= -32:
+		return append(b,byte(n))
+	case n >= math.MinInt8:
+		return append(b,mpInt8,byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b,mpInt16),uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b,mpInt32),uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b,mpInt64),uint64(n))
+	}
+}
+
+func msgpackAppendUint(b []byte, n uint64)[]byte{
+	switch{
+	case n <= 0x7f:
+		return append(b,byte(n))
+	case n <= math.MaxUint8:
+		return append(b,mpUint8,byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b,mpUint16),uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b,mpUint32),uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b,mpUint64),n)
+	}
+}
+
+func msgpackAppendString(b []byte, s string)[]byte{
+	switch n := len(s);{
+	case n < 32:
+		b = append(b,0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b,mpStr8,byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b,mpStr16),uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b,mpStr32),uint32(n))
+	}
+	return append(b,s...)
+}
+
+func msgpackAppendBytes(b []byte, p []byte)[]byte{
+	switch n := len(p);{
+	case n <= math.MaxUint8:
+		b = append(b,mpBin8,byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b,mpBin16),uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b,mpBin32),uint32(n))
+	}
+	return append(b,p...)
+}
+
+// array and map headers share the same layout, only the codes differ
+func msgpackAppendLen(b []byte, n int, fix, code16, code32 byte)[]byte{
+	switch{
+	case n < 16:
+		return append(b,fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b,code16),uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b,code32),uint32(n))
+	}
+}
+
+func msgpackAppendArray(b []byte, v reflect.Value)([]byte,error){
+	b = msgpackAppendLen(b,v.Len(),0x90,mpArray16,mpArray32)
+	var err error
+	for i := 0;i < v.Len();i++{
+		if b, err = msgpackAppend(b,v.Index(i));err != nil{
+			return nil, err
+		}
+	}
+	return b,nil
+}
+
+// reader the decoder works on, bufio.Reader and bytes.Reader both fit
+type msgpackReader interface{
+	io.Reader
+	io.ByteReader
+}
+
+// lengths come from the peer, so none is trusted beyond the bytes the input can still hold.
+// every str or bin byte and every array or map element takes at least one byte
+type msgpackDecoder struct{
+	r msgpackReader
+	left int // bytes the current message may still take
+	limit int // left at the start of every message read off a stream, 0 when r holds a single message
+	depth int // values being decoded inside one another
+}
+
+// deeper nesting than this is refused instead of running out of stack, like encoding/json does
+const msgpackMaxDepth = 10000
+
+var (
+	errMsgpackLength = errors.New("codec: msgpack length exceeds the input")
+	errMsgpackDepth = errors.New("codec: msgpack values nested too deep")
+)
+
+// decode the next value into v, a nil v drops the value
+func (d *msgpackDecoder)Decode(v interface{})error{
+	if d.limit > 0{
+		d.left = d.limit
+	}
+	code, err := d.readByte()
+	if err != nil{
+		return err
+	}
+	if v == nil{
+		_, err = d.decodeInterface(code)
+		return err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil(){
+		return errMsgpackNotPtr
+	}
+	return d.decodeValue(code,rv.Elem())
+}
+
+func (d *msgpackDecoder)readByte()(byte,error){
+	if d.left < 1{
+		return 0, errMsgpackLength
+	}
+	d.left--
+	return d.r.ReadByte()
+}
+
+func (d *msgpackDecoder)readN(n int)([]byte,error){
+	if n > d.left{
+		return nil, errMsgpackLength
+	}
+	d.left -= n
+	p := make([]byte,n)
+	if _, err := io.ReadFull(d.r,p);err != nil{
+		if err == io.EOF{
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return p,nil
+}
+
+func (d *msgpackDecoder)readUint(size int)(uint64,error){
+	p, err := d.readN(size)
+	if err != nil{
+		return 0, err
+	}
+	switch size{
+	case 1:
+		return uint64(p[0]),nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(p)),nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(p)),nil
+	default:
+		return binary.BigEndian.Uint64(p),nil
+	}
+}
+
+// length of a str or bin value, ok is false when code is neither
+func (d *msgpackDecoder)bytesLen(code byte)(n int, ok bool, err error){
+	var u uint64
+	switch{
+	case code&0xe0 == 0xa0:
+		return int(code&0x1f),true,nil
+	case code == mpStr8 || code == mpBin8:
+		u, err = d.readUint(1)
+	case code == mpStr16 || code == mpBin16:
+		u, err = d.readUint(2)
+	case code == mpStr32 || code == mpBin32:
+		u, err = d.readUint(4)
+	default:
+		return 0,false,nil
+	}
+	if err == nil && u > uint64(d.left){
+		err = errMsgpackLength
+	}
+	return int(u),true,err
+}
+
+// length of an array (fix=0x90) or map (fix=0x80), ok is false for other codes
+func (d *msgpackDecoder)containerLen(code, fix, code16, code32 byte)(n int, ok bool, err error){
+	var u uint64
+	switch{
+	case code&0xf0 == fix:
+		return int(code&0x0f),true,nil
+	case code == code16:
+		u, err = d.readUint(2)
+	case code == code32:
+		u, err = d.readUint(4)
+	default:
+		return 0,false,nil
+	}
+	if err == nil && u > uint64(d.left){
+		err = errMsgpackLength
+	}
+	return int(u),true,err
+}
+
+// read any number, signed values are reported through i and isInt
+func (d *msgpackDecoder)number(code byte)(i int64, u uint64, f float64, kind reflect.Kind, err error){
+	switch{
+	case code <= 0x7f:
+		return 0,uint64(code),0,reflect.Uint64,nil
+	case code >= 0xe0:
+		return int64(int8(code)),0,0,reflect.Int64,nil
+	}
+	switch code{
+	case mpUint8, mpUint16, mpUint32, mpUint64:
+		u, err = d.readUint(1<<(code-mpUint8))
+		return 0,u,0,reflect.Uint64,err
+	case mpInt8, mpInt16, mpInt32, mpInt64:
+		size := 1<<(code-mpInt8)
+		u, err = d.readUint(size)
+		switch size{
+		case 1:
+			i = int64(int8(u))
+		case 2:
+			i = int64(int16(u))
+		case 4:
+			i = int64(int32(u))
+		default:
+			i = int64(u)
+		}
+		return i,0,0,reflect.Int64,err
+	case mpFloat32:
+		u, err = d.readUint(4)
+		return 0,0,float64(math.Float32frombits(uint32(u))),reflect.Float64,err
+	case mpFloat64:
+		u, err = d.readUint(8)
+		return 0,0,math.Float64frombits(u),reflect.Float64,err
+	}
+	return 0,0,0,reflect.Invalid,fmt.Errorf("codec: msgpack code %#x is not a number",code)
+}
+
+func (d *msgpackDecoder)decodeValue(code byte, v reflect.Value)error{
+	if code == mpNil{
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	switch v.Kind(){
+	case reflect.Ptr:
+		if v.IsNil(){
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeValue(code,v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0{
+			return fmt.Errorf("codec: msgpack cannot decode into %s",v.Type())
+		}
+		x, err := d.decodeInterface(code)
+		if err != nil{
+			return err
+		}
+		if x != nil{
+			v.Set(reflect.ValueOf(x))
+		}
+		return nil
+	case reflect.Bool:
+		if code != mpTrue && code != mpFalse{
+			return fmt.Errorf("codec: msgpack code %#x is not a bool",code)
+		}
+		v.SetBool(code == mpTrue)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return d.decodeNumber(code,v)
+	case reflect.String:
+		n, ok, err := d.bytesLen(code)
+		if err != nil{
+			return err
+		}
+		if !ok{
+			return fmt.Errorf("codec: msgpack code %#x is not a string",code)
+		}
+		p, err := d.readN(n)
+		if err != nil{
+			return err
+		}
+		v.SetString(string(p))
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8{
+			if n, ok, err := d.bytesLen(code);ok || err != nil{
+				if err != nil{
+					return err
+				}
+				p, err := d.readN(n)
+				if err != nil{
+					return err
+				}
+				v.SetBytes(p)
+				return nil
+			}
+		}
+		n, ok, err := d.containerLen(code,0x90,mpArray16,mpArray32)
+		if err != nil{
+			return err
+		}
+		if !ok{
+			return fmt.Errorf("codec: msgpack code %#x is not an array",code)
+		}
+		v.Set(reflect.MakeSlice(v.Type(),n,n))
+		return d.decodeElems(n,v)
+	case reflect.Array:
+		n, ok, err := d.containerLen(code,0x90,mpArray16,mpArray32)
+		if err != nil{
+			return err
+		}
+		if !ok || n > v.Len(){
+			return fmt.Errorf("codec: msgpack cannot decode code %#x into %s",code,v.Type())
+		}
+		return d.decodeElems(n,v)
+	case reflect.Map:
+		n, ok, err := d.containerLen(code,0x80,mpMap16,mpMap32)
+		if err != nil{
+			return err
+		}
+		if !ok{
+			return fmt.Errorf("codec: msgpack code %#x is not a map",code)
+		}
+		if v.IsNil(){
+			v.Set(reflect.MakeMapWithSize(v.Type(),n))
+		}
+		for i := 0;i < n;i++{
+			key := reflect.New(v.Type().Key()).Elem()
+			val := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decodeNext(key);err != nil{
+				return err
+			}
+			if err := d.decodeNext(val);err != nil{
+				return err
+			}
+			v.SetMapIndex(key,val)
+		}
+		return nil
+	case reflect.Struct:
+		return d.decodeStruct(code,v)
+	default:
+		return fmt.Errorf("codec: msgpack cannot decode into %s",v.Type())
+	}
+}
+
+// every nested value is read through here, which bounds the recursion
+func (d *msgpackDecoder)decodeNext(v reflect.Value)error{
+	if d.depth >= msgpackMaxDepth{
+		return errMsgpackDepth
+	}
+	d.depth++
+	defer func(){d.depth--}()
+	code, err := d.readByte()
+	if err != nil{
+		if err == io.EOF{
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return d.decodeValue(code,v)
+}
+
+func (d *msgpackDecoder)decodeElems(n int, v reflect.Value)error{
+	for i := 0;i < n;i++{
+		if err := d.decodeNext(v.Index(i));err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *msgpackDecoder)decodeNumber(code byte, v reflect.Value)error{
+	i, u, f, kind, err := d.number(code)
+	if err != nil{
+		return err
+	}
+	switch v.Kind(){
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch kind{
+		case reflect.Uint64:
+			if u > math.MaxInt64{
+				return fmt.Errorf("codec: msgpack value %d overflows %s",u,v.Type())
+			}
+			i = int64(u)
+		case reflect.Float64:
+			return fmt.Errorf("codec: msgpack cannot decode float into %s",v.Type())
+		}
+		if v.OverflowInt(i){
+			return fmt.Errorf("codec: msgpack value %d overflows %s",i,v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Float32, reflect.Float64:
+		switch kind{
+		case reflect.Uint64:
+			f = float64(u)
+		case reflect.Int64:
+			f = float64(i)
+		}
+		v.SetFloat(f)
+	default:
+		switch kind{
+		case reflect.Int64:
+			if i < 0{
+				return fmt.Errorf("codec: msgpack value %d overflows %s",i,v.Type())
+			}
+			u = uint64(i)
+		case reflect.Float64:
+			return fmt.Errorf("codec: msgpack cannot decode float into %s",v.Type())
+		}
+		if v.OverflowUint(u){
+			return fmt.Errorf("codec: msgpack value %d overflows %s",u,v.Type())
+		}
+		v.SetUint(u)
+	}
+	return nil
+}
+
+func (d *msgpackDecoder)decodeStruct(code byte, v reflect.Value)error{
+	n, ok, err := d.containerLen(code,0x80,mpMap16,mpMap32)
+	if err != nil{
+		return err
+	}
+	if !ok{
+		return fmt.Errorf("codec: msgpack code %#x cannot be decoded into %s",code,v.Type())
+	}
+	fields := msgpackFields(v.Type())
+	for i := 0;i < n;i++{
+		var name string
+		if err := d.decodeNext(reflect.ValueOf(&name).Elem());err != nil{
+			return err
+		}
+		index := -1
+		for _, f := range fields{
+			if f.name == name{
+				index = f.index
+				break
+			}
+		}
+		if index < 0{
+			// unknown field, drop its value. it still counts against the message's bytes
+			var skipped interface{}
+			if err := d.decodeNext(reflect.ValueOf(&skipped).Elem());err != nil{
+				return err
+			}
+			continue
+		}
+		if err := d.decodeNext(v.Field(index));err != nil{
+			return err
+		}
+	}
+	return nil
+}
+
+// decode into the natural go representation, used for interface{} targets and for skipping
+func (d *msgpackDecoder)decodeInterface(code byte)(interface{},error){
+	switch{
+	case code == mpNil:
+		return nil,nil
+	case code == mpTrue || code == mpFalse:
+		return code == mpTrue,nil
+	}
+	if n, ok, err := d.bytesLen(code);ok || err != nil{
+		if err != nil{
+			return nil, err
+		}
+		p, err := d.readN(n)
+		if err != nil{
+			return nil, err
+		}
+		if code == mpBin8 || code == mpBin16 || code == mpBin32{
+			return p,nil
+		}
+		return string(p),nil
+	}
+	if n, ok, err := d.containerLen(code,0x90,mpArray16,mpArray32);ok || err != nil{
+		if err != nil{
+			return nil, err
+		}
+		arr := make([]interface{},n)
+		return arr,d.decodeElems(n,reflect.ValueOf(arr))
+	}
+	if n, ok, err := d.containerLen(code,0x80,mpMap16,mpMap32);ok || err != nil{
+		if err != nil{
+			return nil, err
+		}
+		m := make(map[string]interface{},n)
+		for i := 0;i < n;i++{
+			var key, val interface{}
+			if err := d.decodeNext(reflect.ValueOf(&key).Elem());err != nil{
+				return nil, err
+			}
+			if err := d.decodeNext(reflect.ValueOf(&val).Elem());err != nil{
+				return nil, err
+			}
+			m[fmt.Sprint(key)] = val
+		}
+		return m,nil
+	}
+	i, u, f, kind, err := d.number(code)
+	switch kind{
+	case reflect.Int64:
+		return i,err
+	case reflect.Uint64:
+		return u,err
+	default:
+		return f,err
+	}
+}
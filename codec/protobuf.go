@@ -0,0 +1,335 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+)
+
+// ProtoMessage is implemented by message types generated from .proto files
+// (gogo style generated code, or hand written wrappers around proto.Marshal)
+type ProtoMessage interface{
+	Marshal()([]byte,error)
+	Unmarshal(data []byte)error
+}
+
+// protobuf wire types
+const (
+	wireVarint = 0
+	wireFixed64 = 1
+	wireBytes = 2
+	wireFixed32 = 5
+)
+
+// ProtobufCodec writes every header and body as a varint length-delimited protobuf message.
+// the header has its own schema, see appendProtoHeader; bodies must be ProtoMessage
+type ProtobufCodec struct{
+	conn io.ReadWriteCloser
+	r *bufio.Reader
+	buf *bufio.Writer
+	maxFrameSize int
+}
+
+var _ Codec = (*ProtobufCodec)(nil)
+var _ FrameLimiter = (*ProtobufCodec)(nil)
+
+func NewProtobufCodec(conn io.ReadWriteCloser)Codec{
+	return &ProtobufCodec{
+		conn: conn,
+		r: bufio.NewReader(conn),
+		buf: bufio.NewWriter(conn),
+		maxFrameSize: DefaultMaxFrameSize,
+	}
+}
+
+// bound every header and body to n bytes, n <= 0 means DefaultMaxFrameSize. set it before the codec is used
+func (c *ProtobufCodec)SetMaxFrameSize(n int){
+	if n <= 0{
+		n = DefaultMaxFrameSize
+	}
+	c.maxFrameSize = n
+}
+
+func (c *ProtobufCodec)readMessage()([]byte,error){
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil{
+		return nil, err
+	}
+	// the rest of the message is not read, so the connection cannot go on
+	if n > uint64(c.maxFrameSize){
+		_ = c.Close()
+		return nil, fmt.Errorf("%w: %d > %d",ErrFrameTooLarge,n,c.maxFrameSize)
+	}
+	data := make([]byte,n)
+	if _, err := io.ReadFull(c.r,data);err != nil{
+		if err == io.EOF{
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data,nil
+}
+
+func (c *ProtobufCodec)ReadHeader(h *Header)error{
+	data, err := c.readMessage()
+	if err != nil{
+		return err
+	}
+	return protoUnmarshal(data,h)
+}
+
+func (c *ProtobufCodec)ReadBody(body interface{})error{
+	data, err := c.readMessage()
+	if err != nil{
+		return err
+	}
+	return protoUnmarshal(data,body)
+}
+
+func (c *ProtobufCodec)Write(h *Header,body interface{})(err error){
+	defer func(){
+		if errors.Is(err,ErrFrameTooLarge){
+			return // nothing was written, the connection stays usable
+		}
+		_ = c.buf.Flush()
+		if err != nil{
+			_ = c.Close()
+		}
+	}()
+
+	hdata, err := protoMarshal(h)
+	if err != nil{
+		log.Println("rpc codec: protobuf error encoding header:",err)
+		return err
+	}
+	bdata, err := protoMarshal(body)
+	if err != nil{
+		log.Println("rpc codec: protobuf error encoding body:",err)
+		return err
+	}
+	for _, part := range [][]byte{hdata,bdata}{
+		if len(part) > c.maxFrameSize{
+			return fmt.Errorf("%w: %d > %d",ErrFrameTooLarge,len(part),c.maxFrameSize)
+		}
+	}
+	var data []byte
+	data = append(binary.AppendUvarint(data,uint64(len(hdata))),hdata...)
+	data = append(binary.AppendUvarint(data,uint64(len(bdata))),bdata...)
+	_, err = c.buf.Write(data)
+	return err
+}
+
+func (c *ProtobufCodec)Close()error{
+	return c.conn.Close()
+}
+
+// ProtobufSerializer lets protobuf run on top of the framing layer
+type ProtobufSerializer struct{}
+
+func (ProtobufSerializer)Marshal(v interface{})([]byte,error){
+	return protoMarshal(v)
+}
+
+func (ProtobufSerializer)Unmarshal(data []byte, v interface{})error{
+	return protoUnmarshal(data,v)
+}
+
+var errNotProtoMessage = errors.New("codec: protobuf body does not implement codec.ProtoMessage")
+
+// find the ProtoMessage behind v, values whose pointer implements it are copied
+func asProtoMessage(v interface{})(ProtoMessage,bool){
+	if m, ok := v.(ProtoMessage);ok{
+		return m,true
+	}
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || rv.Kind() == reflect.Ptr{
+		return nil,false
+	}
+	p := reflect.New(rv.Type())
+	p.Elem().Set(rv)
+	m, ok := p.Interface().(ProtoMessage)
+	return m,ok
+}
+
+func protoMarshal(v interface{})([]byte,error){
+	switch v := v.(type){
+	case *Header:
+		return appendProtoHeader(nil,v),nil
+	case nil, struct{}:
+		// empty message, used for error responses
+		return nil,nil
+	}
+	m, ok := asProtoMessage(v)
+	if !ok{
+		return nil, fmt.Errorf("%w: %T",errNotProtoMessage,v)
+	}
+	return m.Marshal()
+}
+
+func protoUnmarshal(data []byte, v interface{})error{
+	switch v := v.(type){
+	case *Header:
+		*v = Header{}
+		return parseProtoHeader(data,v)
+	case nil, *struct{}:
+		return nil
+	}
+	m, ok := v.(ProtoMessage)
+	if !ok{
+		return fmt.Errorf("%w: %T",errNotProtoMessage,v)
+	}
+	// generated code merges into existing fields, start from a clean message
+	if r, ok := m.(interface{ Reset() });ok{
+		r.Reset()
+	}
+	return m.Unmarshal(data)
+}
+
+// header schema:
+//   string service_method = 1;
+//   uint64 seq = 2;
+//   string error = 3;
+//   map<string, string> metadata = 4;
+//   uint32 code = 5;
+//   map<string, string> details = 6;
+//   uint32 kind = 7;
+//   int64 timeout = 8;
+//   uint32 window = 9;
+func appendProtoHeader(b []byte, h *Header)[]byte{
+	b = appendProtoString(b,1,h.ServiceMethod)
+	b = appendProtoUint(b,2,h.Seq)
+	b = appendProtoString(b,3,h.Error)
+	b = appendProtoMap(b,4,h.Metadata)
+	b = appendProtoUint(b,5,uint64(h.Code))
+	b = appendProtoMap(b,6,h.Details)
+	b = appendProtoUint(b,7,uint64(h.Kind))
+	b = appendProtoUint(b,8,uint64(h.Timeout))
+	b = appendProtoUint(b,9,uint64(h.Window))
+	return b
+}
+
+func parseProtoHeader(data []byte, h *Header)error{
+	return walkProtoFields(data,func(field int, wire int, u uint64, p []byte)error{
+		switch{
+		case field == 1 && wire == wireBytes:
+			h.ServiceMethod = string(p)
+		case field == 2 && wire == wireVarint:
+			h.Seq = u
+		case field == 3 && wire == wireBytes:
+			h.Error = string(p)
+		case field == 4 && wire == wireBytes:
+			if h.Metadata == nil{
+				h.Metadata = make(map[string]string)
+			}
+			return parseProtoMapEntry(p,h.Metadata)
+		case field == 5 && wire == wireVarint:
+			h.Code = uint32(u)
+		case field == 6 && wire == wireBytes:
+			if h.Details == nil{
+				h.Details = make(map[string]string)
+			}
+			return parseProtoMapEntry(p,h.Details)
+		case field == 7 && wire == wireVarint:
+			h.Kind = Kind(u)
+		case field == 8 && wire == wireVarint:
+			h.Timeout = int64(u)
+		case field == 9 && wire == wireVarint:
+			h.Window = uint32(u)
+		}
+		return nil
+	})
+}
+
+func appendProtoTag(b []byte, field int, wire int)[]byte{
+	return binary.AppendUvarint(b,uint64(field)<<3|uint64(wire))
+}
+
+// zero values are left out, as proto3 does
+func appendProtoUint(b []byte, field int, u uint64)[]byte{
+	if u == 0{
+		return b
+	}
+	return binary.AppendUvarint(appendProtoTag(b,field,wireVarint),u)
+}
+
+// empty strings are left out too
+func appendProtoString(b []byte, field int, s string)[]byte{
+	if s == ""{
+		return b
+	}
+	b = binary.AppendUvarint(appendProtoTag(b,field,wireBytes),uint64(len(s)))
+	return append(b,s...)
+}
+
+// maps are repeated entry messages with key = 1 and value = 2
+func appendProtoMap(b []byte, field int, m map[string]string)[]byte{
+	for k, v := range m{
+		entry := appendProtoString(appendProtoString(nil,1,k),2,v)
+		b = binary.AppendUvarint(appendProtoTag(b,field,wireBytes),uint64(len(entry)))
+		b = append(b,entry...)
+	}
+	return b
+}
+
+func parseProtoMapEntry(data []byte, m map[string]string)error{
+	var k, v string
+	err := walkProtoFields(data,func(field int, wire int, u uint64, p []byte)error{
+		switch{
+		case field == 1 && wire == wireBytes:
+			k = string(p)
+		case field == 2 && wire == wireBytes:
+			v = string(p)
+		}
+		return nil
+	})
+	m[k] = v
+	return err
+}
+
+// call fn for every field in data, u holds varint and fixed values, p holds bytes values
+func walkProtoFields(data []byte, fn func(field int, wire int, u uint64, p []byte)error)error{
+	for len(data) > 0{
+		key, n := binary.Uvarint(data)
+		if n <= 0{
+			return errors.New("codec: protobuf bad field key")
+		}
+		data = data[n:]
+		field, wire := int(key>>3),int(key&7)
+		var u uint64
+		var p []byte
+		switch wire{
+		case wireVarint:
+			u, n = binary.Uvarint(data)
+			if n <= 0{
+				return errors.New("codec: protobuf bad varint")
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8{
+				return io.ErrUnexpectedEOF
+			}
+			u, data = binary.LittleEndian.Uint64(data),data[8:]
+		case wireFixed32:
+			if len(data) < 4{
+				return io.ErrUnexpectedEOF
+			}
+			u, data = uint64(binary.LittleEndian.Uint32(data)),data[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l{
+				return io.ErrUnexpectedEOF
+			}
+			p, data = data[n:n+int(l)],data[n+int(l):]
+		default:
+			return fmt.Errorf("codec: protobuf unsupported wire type %d",wire)
+		}
+		if err := fn(field,wire,u,p);err != nil{
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorpc/codec"
+)
+
+// Code classifies why a call failed, so callers can decide what to do without matching strings
+type Code uint32
+
+const (
+	OK Code = iota
+	Canceled // the caller gave up on the call
+	Unknown // the handler returned a plain error
+	InvalidArgument // the request could not be decoded or was malformed
+	DeadlineExceeded // the call did not finish in time
+	NotFound // no such service or method
+	PermissionDenied // the caller is not allowed to make the call
+	ResourceExhausted // a limit such as the frame size was hit
+	Unavailable // the connection or server is shutting down, retrying elsewhere may work
+	Internal // something broke inside the server, e.g. a handler panicked
+	Unauthenticated // the caller could not be identified
+)
+
+var codeNames = [...]string{
+	OK: "ok",
+	Canceled: "canceled",
+	Unknown: "unknown",
+	InvalidArgument: "invalid argument",
+	DeadlineExceeded: "deadline exceeded",
+	NotFound: "not found",
+	PermissionDenied: "permission denied",
+	ResourceExhausted: "resource exhausted",
+	Unavailable: "unavailable",
+	Internal: "internal",
+	Unauthenticated: "unauthenticated",
+}
+
+func (c Code)String()string{
+	if int(c) < len(codeNames){
+		return codeNames[c]
+	}
+	return fmt.Sprintf("code(%d)",uint32(c))
+}
+
+// Error is the error type of every failed call, on both sides of the connection.
+// handlers may return one to pick the code the client sees
+type Error struct{
+	Code Code
+	Message string
+	Details map[string]string // optional structured information, e.g. which field was invalid
+}
+
+var _ error = (*Error)(nil)
+
+func (e *Error)Error()string{
+	return e.Message
+}
+
+// errors.Is matches errors with the same code, and the same message when target has one
+func (e *Error)Is(target error)bool{
+	t, ok := target.(*Error)
+	if !ok{
+		return false
+	}
+	return e.Code == t.Code && (t.Message == "" || e.Message == t.Message)
+}
+
+// Errorf builds an *Error with the given code
+func Errorf(code Code, format string, a ...interface{})*Error{
+	return &Error{Code: code,Message: fmt.Sprintf(format,a...)}
+}
+
+// CodeOf returns the code of err, OK for nil and Unknown for errors that carry none
+func CodeOf(err error)Code{
+	var e *Error
+	switch{
+	case err == nil:
+		return OK
+	case errors.As(err,&e):
+		return e.Code
+	case errors.Is(err,context.Canceled):
+		return Canceled
+	case errors.Is(err,context.DeadlineExceeded):
+		return DeadlineExceeded
+	case errors.Is(err,codec.ErrFrameTooLarge):
+		return ResourceExhausted
+	default:
+		return Unknown
+	}
+}
+
+// turn any error into an *Error, keeping the code when there is one
+func toError(err error)*Error{
+	var e *Error
+	if errors.As(err,&e){
+		return e
+	}
+	return &Error{Code: CodeOf(err),Message: err.Error()}
+}
+
+// put err into a response header
+func setHeaderError(h *codec.Header, err error){
+	e := toError(err)
+	h.Error = e.Message
+	h.Code = uint32(e.Code)
+	h.Details = e.Details
+}
+
+// read the error out of a response header, nil when the call succeeded
+func headerError(h *codec.Header)error{
+	if h.Error == "" && h.Code == uint32(OK){
+		return nil
+	}
+	code := Code(h.Code)
+	if code == OK{
+		code = Unknown
+	}
+	return &Error{Code: code,Message: h.Error,Details: h.Details}
+}
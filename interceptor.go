@@ -0,0 +1,76 @@
+package gorpc
+
+import (
+	"context"
+	"reflect"
+)
+
+// MethodInfo describes the call an interceptor wraps
+type MethodInfo struct{
+	Service string // service name as registered
+	Method string
+}
+
+// "Service.Method", as the client wrote it
+func (info *MethodInfo)FullMethod()string{
+	return info.Service+"."+info.Method
+}
+
+// Handler runs the rest of the chain, the last one calls the service method
+type Handler func(ctx context.Context, args, reply interface{})error
+
+// Interceptor wraps every call on a server. it may inspect or change ctx, args and reply,
+// call next to continue, or return an error without calling next to stop the call.
+// for streaming methods reply is the ServerStream
+type Interceptor func(ctx context.Context, info *MethodInfo, args, reply interface{}, next Handler)error
+
+// Use adds interceptors to the server, they run in the order they were added
+func (server *Server)Use(interceptors ...Interceptor){
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	// copy so requests already running keep the chain they started with
+	chain := make([]Interceptor,0,len(server.interceptors)+len(interceptors))
+	chain = append(chain,server.interceptors...)
+	server.interceptors = append(chain,interceptors...)
+}
+
+func (server *Server)chain()[]Interceptor{
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.interceptors
+}
+
+// run the request through the interceptors and into the service method
+func (server *Server)invoke(ctx context.Context, req *request)error{
+	var h Handler = func(ctx context.Context, args, reply interface{})error{
+		return req.svc.call(ctx,req.mtype,reflect.ValueOf(args),reflect.ValueOf(reply))
+	}
+	info := &MethodInfo{Service: req.svc.name,Method: req.mtype.method.Name}
+	chain := server.chain()
+	for i := len(chain)-1;i >= 0;i--{
+		interceptor, next := chain[i],h
+		h = func(ctx context.Context, args, reply interface{})error{
+			return interceptor(ctx,info,args,reply,next)
+		}
+	}
+	return h(ctx,req.argv.Interface(),req.replyv.Interface())
+}
+
+// Invoker performs a call, the last one in the chain sends it over the connection
+type Invoker func(ctx context.Context, serviceMethod string, args, reply interface{})error
+
+// ClientInterceptor wraps Client.Call and Client.Go. it may change the service method, args, reply
+// and the outgoing metadata of ctx before calling invoke, and inspect or replace the error it returns
+type ClientInterceptor func(ctx context.Context, serviceMethod string, args, reply interface{}, invoke Invoker)error
+
+// wrap invoke with the client's interceptors, the first one installed runs first
+func (client *Client)intercept(invoke Invoker)Invoker{
+	chain := client.opt.Interceptors
+	for i := len(chain)-1;i >= 0;i--{
+		interceptor, next := chain[i],invoke
+		invoke = func(ctx context.Context, serviceMethod string, args, reply interface{})error{
+			return interceptor(ctx,serviceMethod,args,reply,next)
+		}
+	}
+	return invoke
+}
@@ -0,0 +1,97 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Metadata carries key/value pairs next to a request or a response,
+// things like auth tokens, tenant ids or trace ids that do not belong in the arguments
+type Metadata map[string]string
+
+func (md Metadata)Get(key string)string{
+	return md[key]
+}
+
+func (md Metadata)Set(key, value string){
+	md[key] = value
+}
+
+// return a copy that can be changed without touching md
+func (md Metadata)Copy()Metadata{
+	if md == nil{
+		return nil
+	}
+	cp := make(Metadata,len(md))
+	for k, v := range md{
+		cp[k] = v
+	}
+	return cp
+}
+
+type outgoingKey struct{}
+type incomingKey struct{}
+type trailerSinkKey struct{}
+type trailerKey struct{}
+
+// NewOutgoingContext attaches md to ctx, Client.Call sends it along with the request
+func NewOutgoingContext(ctx context.Context, md Metadata)context.Context{
+	return context.WithValue(ctx,outgoingKey{},md)
+}
+
+// OutgoingMetadata returns metadata attached by NewOutgoingContext
+func OutgoingMetadata(ctx context.Context)(Metadata,bool){
+	md, ok := ctx.Value(outgoingKey{}).(Metadata)
+	return md,ok
+}
+
+// WithTrailer makes Client.Call store the metadata sent back with the response into md
+func WithTrailer(ctx context.Context, md *Metadata)context.Context{
+	return context.WithValue(ctx,trailerSinkKey{},md)
+}
+
+// IncomingMetadata returns metadata the client sent with the request, for use in handlers
+func IncomingMetadata(ctx context.Context)(Metadata,bool){
+	md, ok := ctx.Value(incomingKey{}).(Metadata)
+	return md,ok
+}
+
+// metadata the handler wants to send back, filled by SetTrailer
+type trailer struct{
+	mu sync.Mutex
+	md Metadata
+}
+
+func (t *trailer)get()Metadata{
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.md.Copy()
+}
+
+var errNoTrailer = errors.New("rpc server: context does not belong to a request")
+
+// SetTrailer merges md into the metadata sent back with the response.
+// it only works on the context passed to a handler
+func SetTrailer(ctx context.Context, md Metadata)error{
+	t, ok := ctx.Value(trailerKey{}).(*trailer)
+	if !ok{
+		return errNoTrailer
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.md == nil{
+		t.md = make(Metadata,len(md))
+	}
+	for k, v := range md{
+		t.md[k] = v
+	}
+	return nil
+}
+
+// context a handler sees: the request's metadata plus a place for its trailer
+func newRequestContext(ctx context.Context, md Metadata)(context.Context,*trailer){
+	t := new(trailer)
+	ctx = context.WithValue(ctx,incomingKey{},md)
+	return context.WithValue(ctx,trailerKey{},t),t
+}
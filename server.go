@@ -1,17 +1,22 @@
 package gorpc
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"go/token"
 	"gorpc/codec"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"reflect"
+	rtdebug "runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,8 +26,24 @@ const MagicNumber = 0x3bef5c
 type Option struct{
 	MagicNumber int // we use this magic number to mark a go rpc request
 	CodecType codec.Type // client may use different type of encoding
+	AcceptCodecs []codec.Type // codecs the client accepts in order of preference, CodecType is used when empty
+	Framing bool // wrap every header and body in a length-prefixed frame, if the codec supports it
+	Compression string // name of a registered codec.Compressor, implies Framing
+	CompressThreshold int // frames smaller than this are not compressed, 0 means codec.DefaultCompressThreshold
 	ConnectTimeout time.Duration
 	HandleTimeout time.Duration
+	// wrap every Call and Go of clients created with this option, they are not sent to the server
+	Interceptors []ClientInterceptor `json:"-"`
+	// used by XDial for "tls@host:port" addresses
+	TLSConfig *tls.Config `json:"-"`
+	// supplies the token presented to the server's Authenticator, sent separately from the option
+	Credentials CredentialProvider `json:"-"`
+	// messages each side of a stream may have in flight, 0 means DefaultStreamWindow.
+	// the server may settle on a smaller one, see Server.MaxStreamWindow
+	StreamWindow int
+	// largest frame the client reads or writes, 0 means codec.DefaultMaxFrameSize.
+	// the server applies its own Server.MaxFrameSize
+	MaxFrameSize int `json:"-"`
 }
 
 const (
@@ -32,6 +53,39 @@ const (
 )
 
 
+// server's answer to the option, sent before any codec traffic starts
+type handshakeReply struct{
+	CodecType codec.Type // codec chosen by server
+	Framing bool // whether the connection is framed
+	Compression string `json:",omitempty"` // compressor used on this connection, empty when none
+	Error string `json:",omitempty"`
+	Code Code `json:",omitempty"` // why the handshake failed
+}
+
+// compression only works on framed connections, so asking for it asks for framing
+func (opt *Option)framing()bool{
+	return opt.Framing || opt.Compression != ""
+}
+
+// codecs the client is willing to speak, in order of preference
+func (opt *Option)acceptCodecs()[]codec.Type{
+	if len(opt.AcceptCodecs) == 0{
+		return []codec.Type{opt.CodecType}
+	}
+	return opt.AcceptCodecs
+}
+
+// write v as a single json value, without the trailing newline json.Encoder adds,
+// so nothing is left on the wire for the codec to trip over
+func writeJSON(conn io.Writer, v interface{})error{
+	data, err := json.Marshal(v)
+	if err != nil{
+		return err
+	}
+	_,err = conn.Write(data)
+	return err
+}
+
 var DefaultOption = &Option{
 	MagicNumber: MagicNumber,
 	CodecType: codec.GobType,
@@ -42,6 +96,31 @@ var DefaultOption = &Option{
 // RPC server
 type Server struct{
 	serviceMap sync.Map
+	// largest frame accepted on framed connections, and largest message for codecs that
+	// bound their own like protobuf. 0 means codec.DefaultMaxFrameSize. set it before serving
+	MaxFrameSize int
+	// checks the token clients present when connecting, nil lets everyone in. set it before serving
+	Authenticator Authenticator
+	// make Register fail when any exported method has the wrong shape, instead of
+	// skipping it. the error lists every skipped method and why
+	StrictRegister bool
+	// let a panicking service method crash the process instead of failing the call,
+	// handy when debugging. set it before serving
+	CrashOnPanic bool
+	// how long a new connection may take over its tls handshake,
+	// 0 means DefaultOption.ConnectTimeout. set it before serving
+	HandshakeTimeout time.Duration
+	// most calls a batch may carry, 0 means DefaultMaxBatchItems. set it before serving
+	MaxBatchItems int
+	// largest stream window granted, clients asking for more get this one.
+	// 0 means DefaultStreamWindow. set it before serving
+	MaxStreamWindow int
+	mu sync.Mutex // protect following
+	interceptors []Interceptor
+	policy *Policy // nil lets every caller call every method
+	listeners map[net.Listener]struct{}
+	conns map[*serverConn]struct{}
+	inShutdown bool
 }
 
 // Constructor
@@ -53,11 +132,26 @@ var DefaultServer = NewServer()
 
 // to start a server, just pass in a listener object, it support both tcp and unix
 func (server *Server)Accept(lis net.Listener){
+	if err := server.serve(lis);err != nil && err != ErrServerClosed{
+		log.Println("rpc server:accept error",err)
+	}
+}
+
+// serve connections until lis fails, ErrServerClosed when Shutdown closed it
+func (server *Server)serve(lis net.Listener)error{
+	if !server.trackListener(lis,true){
+		_ = lis.Close()
+		return ErrServerClosed
+	}
+	defer server.trackListener(lis,false)
 	for{
 		conn,err := lis.Accept()
 		if err != nil{
-			log.Println("rpc server:accept error",err)
-			return
+			// the listener was closed by Shutdown
+			if server.shuttingDown(){
+				return ErrServerClosed
+			}
+			return err
 		}
 		go server.ServeConn(conn)
 	}
@@ -87,9 +181,20 @@ func (server *Server)ServeHTTP(w http.ResponseWriter, req *http.Request){
 // serve implementation
 func(server *Server)ServeConn(conn io.ReadWriteCloser){
 	defer func(){_ = conn.Close()}()
+	timeout := server.HandshakeTimeout
+	if timeout == 0{
+		timeout = DefaultOption.ConnectTimeout
+	}
+	peer, err := newPeer(conn,timeout)
+	if err != nil{
+		log.Println("rpc server: tls handshake error:",err)
+		return
+	}
+	ctx := context.WithValue(context.Background(),peerKey{},peer)
 	// parse option first
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt);err != nil{
+	hs := handshakeRequest{Option: &opt}
+	if err := json.NewDecoder(conn).Decode(&hs);err != nil{
 		log.Print("rpc server:option error:",err)
 		return
 	}
@@ -99,15 +204,67 @@ func(server *Server)ServeConn(conn io.ReadWriteCloser){
 		return
 	}
 
-	// accoring the the codec type chosen by client, we generate codec.
-	f := codec.NewCodecFuncMap[opt.CodecType]
-
+	// pick the first codec in client's list that we support
+	var f codec.NewCodecFunc
+	var reply handshakeReply
+	for _, t := range opt.acceptCodecs(){
+		if cf, ok := codec.Lookup(t);ok{
+			f, reply.CodecType = cf, t
+			break
+		}
+	}
+	if f == nil{
+		reply.Error = fmt.Sprintf("rpc server: no supported codec in %v",opt.acceptCodecs())
+	}
+	// refuse callers the authenticator does not accept, before any codec traffic
+	if f != nil{
+		principal, err := server.authenticate(ctx,hs.Token)
+		if err != nil{
+			f = nil
+			e := toError(err)
+			reply.Error, reply.Code = e.Message,e.Code
+		}else if principal != nil{
+			ctx = context.WithValue(ctx,principalKey{},principal)
+		}
+	}
+	// frame the connection when asked and the codec can do it
+	var s codec.Serializer
+	if f != nil && opt.framing(){
+		s, reply.Framing = codec.LookupSerializer(reply.CodecType)
+	}
+	// compress it when we know the compressor, otherwise fall back to plain frames
+	var comp codec.Compressor
+	if reply.Framing && opt.Compression != ""{
+		var ok bool
+		if comp, ok = codec.LookupCompressor(opt.Compression);ok{
+			reply.Compression = opt.Compression
+		}
+	}
+	// tell the client what we picked before any codec traffic
+	if err := writeJSON(conn,&reply);err != nil{
+		log.Println("rpc server: handshake error:",err)
+		return
+	}
 	if f == nil{
-		log.Printf("rpc server:invalid codec type %s",opt.CodecType)
-		return 
+		log.Println(reply.Error)
+		return
 	}
+	// from now on the option tells the codec actually spoken, batches encode their calls with it
+	opt.CodecType = reply.CodecType
 	// let codec handle rest of the connection, the connection will be passed into codec in constructor
-	server.serveCodec(f(conn),&opt)
+	if reply.Framing{
+		fc := codec.NewFrameCodec(conn,s,server.MaxFrameSize)
+		if comp != nil{
+			fc.SetCompressor(comp,opt.CompressThreshold)
+		}
+		server.serveCodec(ctx,fc,&opt)
+		return
+	}
+	cc := f(conn)
+	if l, ok := cc.(codec.FrameLimiter);ok{
+		l.SetMaxFrameSize(server.MaxFrameSize)
+	}
+	server.serveCodec(ctx,cc,&opt)
 
 }
 
@@ -116,26 +273,99 @@ var invalidRequest = struct{}{}
 // 1. reanding request
 // 2. handle request
 // 3. send response
-func(server *Server)serveCodec(cc codec.Codec,opt *Option){
+func(server *Server)serveCodec(ctx context.Context, cc codec.Codec,opt *Option){
 	sending := new(sync.Mutex) // we want to send complete response
 	wg := new(sync.WaitGroup) // wait until all requests are handled
+	// cancelled once the connection is gone, so handlers can stop early
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// handlers call methods the client registered through it
+	cb := newCallback(cc,sending)
+	ctx = context.WithValue(ctx,callbackKey{},cb)
+	// nil when the codec has none, then batches are refused
+	serializer, _ := codec.LookupSerializer(opt.CodecType)
+	calls := &inflight{m: make(map[uint64]context.CancelFunc),streams: make(map[uint64]*serverStream)}
+	sc := &serverConn{cc: cc,sending: sending,wg: wg,cancel: cancel}
+	if !server.trackConn(sc,true){
+		_ = cc.Close()
+		return
+	}
+	defer server.trackConn(sc,false)
 	// start to serve request
 	for{
 		// read request and handle error until error occurs.
 		req, err := server.readRequest(cc)
 		if err != nil{
-			if req == nil{
+			if req == nil || !hasArgs(req.h.Kind){
 				break // cannot recover, close the connection
 			}
+			// nobody waits for an answer to a notification
+			if req.h.Kind == codec.KindNotify{
+				log.Printf("rpc server: notification %s error: %v",req.h.ServiceMethod,err)
+				continue
+			}
 			// send request must be sequential or client cannot tell, so we have mutex lock "sending"
-			req.h.Error = err.Error()
+			setHeaderError(req.h,err)
+			server.sendResponse(cc,req.h,invalidRequest,sending)
+			continue
+		}
+		switch req.h.Kind{
+		case codec.KindCancel:
+			calls.cancel(req.h.Seq)
+			continue
+		case codec.KindStreamMsg:
+			if s := calls.stream(req.h.Seq);s != nil{
+				s.receive(cc)
+			}else{
+				_ = cc.ReadBody(nil)
+			}
+			continue
+		case codec.KindStreamEnd:
+			if s := calls.stream(req.h.Seq);s != nil{
+				s.closeSend()
+			}
+			continue
+		case codec.KindWindowUpdate:
+			if s := calls.stream(req.h.Seq);s != nil{
+				s.sendWin.add(int(req.h.Window))
+			}
+			continue
+		case codec.KindCallbackReply:
+			cb.receive(cc,req.h)
+			continue
+		}
+		// the client may not have seen our go away yet
+		if !sc.begin(){
+			if req.h.Kind == codec.KindNotify{
+				continue
+			}
+			setHeaderError(req.h,ErrServerClosed)
 			server.sendResponse(cc,req.h,invalidRequest,sending)
 			continue
 		}
+		// notifications cannot be cancelled and are never answered
+		if req.h.Kind == codec.KindNotify{
+			go server.handleNotify(ctx,req,wg,opt.HandleTimeout)
+			continue
+		}
 		// handle request can be concurrent
-		wg.Add(1)
-		go server.handleRequest(cc,req,sending,wg,opt.HandleTimeout)
+		reqCtx, reqCancel := context.WithCancel(ctx)
+		if req.batch != nil{
+			req.serializer = serializer
+		}else if req.mtype.stream || req.mtype.recv{
+			// register the stream before reading on, the client may send right after opening it
+			req.stream = newServerStream(cc,req,sending,reqCancel,server.MaxStreamWindow)
+		}
+		calls.add(req.h.Seq,reqCancel,req.stream)
+		go func(req *request){
+			server.handleRequest(reqCtx,cc,req,sending,wg,opt.HandleTimeout)
+			calls.remove(req.h.Seq)
+			reqCancel()
+		}(req)
 	}
+	// nobody is waiting for the results any more, and no callback replies will come
+	cancel()
+	cb.terminate()
 	// wailt until all request has been handle
 	wg.Wait()
 	_ = cc.Close()
@@ -143,12 +373,62 @@ func(server *Server)serveCodec(cc codec.Codec,opt *Option){
 }
 
 
+// requests of one connection that are still running, so the client can cancel them
+// and send on their streams by Seq
+type inflight struct{
+	mu sync.Mutex
+	m map[uint64]context.CancelFunc
+	streams map[uint64]*serverStream
+}
+
+func (c *inflight)add(seq uint64, cancel context.CancelFunc, stream *serverStream){
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[seq] = cancel
+	if stream != nil{
+		c.streams[seq] = stream
+	}
+}
+
+func (c *inflight)remove(seq uint64){
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m,seq)
+	delete(c.streams,seq)
+}
+
+func (c *inflight)cancel(seq uint64){
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cancel, ok := c.m[seq];ok{
+		cancel()
+		delete(c.m,seq)
+		delete(c.streams,seq)
+	}
+}
+
+func (c *inflight)stream(seq uint64)*serverStream{
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streams[seq]
+}
+
+// requests and stream openings carry arguments, control messages do not
+func hasArgs(kind codec.Kind)bool{
+	return kind == codec.KindCall || kind == codec.KindStream || kind == codec.KindClientStream || kind == codec.KindNotify ||
+		kind == codec.KindBatch
+}
+
 // create a request struct
 type request struct{
 	h *codec.Header
 	argv, replyv reflect.Value
 	mtype *methodType
 	svc *service
+	stream *serverStream // set for streaming methods
+	batch *codec.Batch // set for batches, which have no method of their own
+	serializer codec.Serializer // encodes the calls of a batch
+	deadline time.Time // when the caller stops waiting, by our own clock
 }
 
 
@@ -171,18 +451,72 @@ func(server *Server)readRequest(cc codec.Codec)(*request,error){
 	if err != nil{
 		return nil, err
 	}
+	return server.readRequestBody(cc,h)
+}
+
+// read the rest of the request h starts
+func(server *Server)readRequestBody(cc codec.Codec, h *codec.Header)(req *request,err error){
 	// create request
-	req := &request{h:h}
+	req = &request{h:h}
+	// the caller sends how long it still waits, count it from when the request arrived
+	if h.Timeout > 0{
+		req.deadline = time.Now().Add(time.Duration(h.Timeout))
+	}
+	// stream messages and callback replies are read by whoever waits for them, it knows their type
+	if h.Kind == codec.KindStreamMsg || h.Kind == codec.KindCallbackReply{
+		return req,nil
+	}
+	switch h.Kind{
+	case codec.KindCancel,codec.KindStreamEnd,codec.KindWindowUpdate:
+		// control messages carry no arguments
+		return req,cc.ReadBody(nil)
+	case codec.KindCall,codec.KindStream,codec.KindClientStream,codec.KindNotify,codec.KindBatch:
+	default:
+		// nothing else is sent to a server, there is no method to hand it to. the request
+		// takes no arguments, so serveCodec gives up on the connection
+		return req,Errorf(InvalidArgument,"rpc server: unexpected message kind %d",h.Kind)
+	}
+	// a batch names its methods inside, each is looked up when it runs
+	if h.Kind == codec.KindBatch{
+		req.batch = new(codec.Batch)
+		if err = cc.ReadBody(req.batch);err != nil && CodeOf(err) == Unknown{
+			err = Errorf(InvalidArgument,"rpc server: read batch error: %v",err)
+		}
+		return req,err
+	}
 	// according to request method string
 	// find service and method
 	req.svc,req.mtype,err = server.findService(h.ServiceMethod)
 	if err != nil{
+		// drop the body so the next header is read from the right place
+		_ = cc.ReadBody(nil)
 		return req,err
 	}
+	// any plain method can be notified
+	kind := h.Kind
+	if kind == codec.KindNotify{
+		kind = codec.KindCall
+	}
+	if want := req.mtype.kind();kind != want{
+		_ = cc.ReadBody(nil)
+		switch want{
+		case codec.KindStream:
+			return req,Errorf(InvalidArgument,"rpc server: %s is a streaming method, use Client.Stream",h.ServiceMethod)
+		case codec.KindClientStream:
+			return req,Errorf(InvalidArgument,"rpc server: %s takes client messages, use Client.OpenStream",h.ServiceMethod)
+		}
+		return req,Errorf(InvalidArgument,"rpc server: %s is not a streaming method",h.ServiceMethod)
+	}
+	// get return, streaming methods get their stream once the request is handled
+	if !req.mtype.stream{
+		req.replyv = req.mtype.newReplyv()
+	}
+	// methods taking client messages get their channel once the request is handled
+	if req.mtype.recv{
+		return req,cc.ReadBody(nil)
+	}
 	// get argument
 	req.argv = req.mtype.newArgv()
-	// get return
-	req.replyv = req.mtype.newReplyv()
 	argvi := req.argv.Interface()
 	// if arguement is not a pointer
 	if req.argv.Type().Kind() != reflect.Ptr{
@@ -191,6 +525,10 @@ func(server *Server)readRequest(cc codec.Codec)(*request,error){
 	// read request
 	if err = cc.ReadBody(argvi);err != nil{
 		log.Println("rpc server:read argv err:",err)
+		if CodeOf(err) == Unknown{
+			err = Errorf(InvalidArgument,"rpc server: read argv error: %v",err)
+		}
+		return req,err
 	}
 	return req,nil
 }
@@ -199,65 +537,244 @@ func(server *Server)readRequest(cc codec.Codec)(*request,error){
 func(server *Server)sendResponse(cc codec.Codec,h *codec.Header, body interface{}, sending *sync.Mutex){
 	sending.Lock()
 	defer sending.Unlock()
-	if err := cc.Write(h,body);err != nil{
-		log.Println("rpc server: write response error")
+	err := cc.Write(h,body)
+	// nothing was written for a reply over the frame limit, fail the call so the client stops waiting
+	if errors.Is(err,codec.ErrFrameTooLarge){
+		eh := &codec.Header{ServiceMethod: h.ServiceMethod,Seq: h.Seq,Kind: h.Kind,Metadata: h.Metadata}
+		setHeaderError(eh,Errorf(ResourceExhausted,"rpc server: reply too large: %v",err))
+		err = cc.Write(eh,invalidRequest)
+	}
+	if err != nil{
+		log.Println("rpc server: write response error:",err)
 	}
 }
 
 
-func(server *Server)handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup,timeout time.Duration){
+// handle one request and send exactly one response for its Seq, whether the call succeeds,
+// fails, panics or times out. a handler still running after a timeout is cancelled and its result dropped.
+// ctx is cancelled when the connection goes away or the client cancels, then nobody waits for an answer
+func(server *Server)handleRequest(ctx context.Context, cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup,timeout time.Duration){
 	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
-	// use a goroutine to run call
+	// the response gets its own header, the handler goroutine may outlive us
+	h := &codec.Header{ServiceMethod: req.h.ServiceMethod,Seq: req.h.Seq}
+	// a stream must not send after the final response
+	stream := req.stream
+	fail := func(err error){
+		stream.close()
+		// the stream failing is what stopped the handler
+		if serr := stream.failure();serr != nil{
+			err = serr
+		}
+		setHeaderError(h,err)
+		server.sendResponse(cc,h,invalidRequest,sending)
+	}
+
+	var cancel context.CancelFunc
+	if timeout > 0{
+		ctx, cancel = context.WithTimeout(ctx,timeout)
+	}else{
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	// stop the handler once we no longer wait for it
+	defer cancel()
+	// the client will not wait past its own deadline, don't start work it will throw away
+	if deadline := req.deadline;!deadline.IsZero(){
+		if !time.Now().Before(deadline){
+			fail(Errorf(DeadlineExceeded,"rpc server: deadline expired before the request was handled"))
+			return
+		}
+		ctx, cancel = context.WithDeadline(ctx,deadline)
+		defer cancel()
+	}
+	// the service is known now, see if the caller may use it before anything runs.
+	// the calls of a batch are checked one by one
+	if req.batch == nil{
+		if err := server.authorize(ctx,req);err != nil{
+			fail(err)
+			return
+		}
+	}
+	ctx, tr := newRequestContext(ctx,req.h.Metadata)
+	if stream != nil{
+		stream.start(ctx)
+		if req.mtype.recv{
+			req.argv = stream.in
+		}
+		if req.mtype.stream{
+			req.replyv = reflect.ValueOf(stream)
+		}
+	}
+
+	// the service may have been unregistered since the request was read
+	if req.batch == nil && !req.svc.begin(){
+		fail(Errorf(NotFound,"rpc server: cannot find service"))
+		return
+	}
+
+	// buffered, so a handler finishing after the timeout does not block forever
+	called := make(chan error,1)
+	start := time.Now()
 	go func(){
-		err :=  req.svc.call(req.mtype,req.argv,req.replyv)
-		// place a holder into channel indicate call is completed
-		called <- struct{}{}
-		if err != nil{
-			req.h.Error = err.Error()
-			server.sendResponse(cc,req.h,invalidRequest,sending)
-			// place a holder into cahnnel indicate sent is completed
-			sent <- struct{}{}
+		if req.batch != nil{
+			called <- server.runBatch(ctx,req)
 			return
 		}
+		defer req.svc.done()
+		called <- server.safeInvoke(ctx,req)
 	}()
 
-	// if not timeout
-	if timeout == 0{
-		<-called
-		<-sent
+	select{
+	case err := <-called:
+		// the response carries the handler's trailer, not the request metadata
+		h.Metadata = tr.get()
+		if err != nil || stream.failure() != nil{
+			fail(err)
+			return
+		}
+		// a stream ends with an empty response, after the reply of a client-streaming method
+		if stream != nil{
+			stream.close()
+			if !req.mtype.stream{
+				if err := stream.sendReply(req.replyv.Interface());err != nil{
+					log.Println("rpc server: send stream reply error:",err)
+				}
+			}
+			server.sendResponse(cc,h,invalidRequest,sending)
+			return
+		}
+		server.sendResponse(cc,h,req.replyv.Interface(),sending)
+	case <-ctx.Done():
+		if ctx.Err() != context.DeadlineExceeded{
+			// the stream failed, tell the client why
+			if stream.failure() != nil{
+				fail(nil)
+			}
+			return // connection is gone or call cancelled, nobody to answer
+		}
+		if timeout > 0 && time.Since(start) >= timeout{
+			fail(Errorf(DeadlineExceeded,"rpc server: request handle time out:expect within %s",timeout))
+			return
+		}
+		fail(Errorf(DeadlineExceeded,"rpc server: client deadline exceeded"))
+	}
+}
+
+
+// run a notification like a request, but only log how it went since nobody waits for it
+func(server *Server)handleNotify(ctx context.Context, req *request, wg *sync.WaitGroup, timeout time.Duration){
+	defer wg.Done()
+	if timeout > 0{
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx,timeout)
+		defer cancel()
+	}
+	if err := server.authorize(ctx,req);err != nil{
+		log.Printf("rpc server: notification %s refused: %v",req.h.ServiceMethod,err)
 		return
 	}
-	// check if timeout reach frist or called completed first
-	select{
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle time out:expect within %s",timeout)
-		server.sendResponse(cc,req.h,invalidRequest,sending)
-	case <-called:
-		<-sent
+	if !req.svc.begin(){
+		return
+	}
+	defer req.svc.done()
+	ctx, _ = newRequestContext(ctx,req.h.Metadata)
+	if err := server.safeInvoke(ctx,req);err != nil{
+		log.Printf("rpc server: notification %s failed: %v",req.h.ServiceMethod,err)
 	}
-	
 }
 
+// invoke the call, a panic becomes an Internal error for this request only
+func(server *Server)safeInvoke(ctx context.Context, req *request)(err error){
+	defer func(){
+		r := recover()
+		if r == nil{
+			return
+		}
+		atomic.AddUint64(&req.mtype.numPanics,1)
+		log.Printf("rpc server: %s panicked: %v\n%s",req.h.ServiceMethod,r,rtdebug.Stack())
+		if server.CrashOnPanic{
+			panic(r)
+		}
+		err = Errorf(Internal,"rpc server: %s panicked: %v",req.h.ServiceMethod,r)
+	}()
+	// remember whose call this is, so the method cannot unregister its own service
+	return server.invoke(context.WithValue(ctx,serviceKey{},req.svc),req)
+}
 
+// Register publishes the methods of rcvr under its type name.
+// it fails when rcvr has no usable methods, or in strict mode when any exported method is skipped
 func(server *Server)Register(rcvr interface{})error{
-	s := newService(rcvr)
+	return server.register("",rcvr)
+}
+
+// RegisterName publishes the methods of rcvr under name instead of its type name,
+// so several values of one type can be served. name may be dotted, like "billing.v2.Invoice"
+func(server *Server)RegisterName(name string, rcvr interface{})error{
+	if err := validServiceName(name);err != nil{
+		return err
+	}
+	return server.register(name,rcvr)
+}
 
+func(server *Server)register(name string, rcvr interface{})error{
+	s, err := newNamedService(name,rcvr,server.StrictRegister)
+	if err != nil{
+		return err
+	}
 	if _, dup := server.serviceMap.LoadOrStore(s.name,s);dup{
-		return errors.New("rpc server: service already registered")
+		return fmt.Errorf("rpc server: service %s already registered",s.name)
+	}
+	return nil
+}
+
+// Unregister removes a service, new calls to it fail with NotFound.
+// it returns once the calls already running have finished, so a method of the service
+// calling it waits for itself forever. methods use UnregisterContext with their ctx instead
+func(server *Server)Unregister(name string)error{
+	return server.UnregisterContext(context.Background(),name)
+}
+
+type serviceKey struct{}
+
+// UnregisterContext is Unregister giving up the wait when ctx is done, the service stays removed.
+// it refuses when ctx is the context of a call to the service itself, that call would never finish
+func(server *Server)UnregisterContext(ctx context.Context, name string)error{
+	svci, ok := server.serviceMap.Load(name)
+	if !ok{
+		return Errorf(NotFound,"rpc server: cannot find service %s",name)
+	}
+	if svc, _ := ctx.Value(serviceKey{}).(*service);svc == svci{
+		return Errorf(InvalidArgument,"rpc server: %s cannot be unregistered from its own method",name)
+	}
+	if svci, ok = server.serviceMap.LoadAndDelete(name);!ok{
+		return Errorf(NotFound,"rpc server: cannot find service %s",name)
+	}
+	return svci.(*service).drain(ctx)
+}
+
+// each dot separated part of a service name must be an identifier
+func validServiceName(name string)error{
+	for _, part := range strings.Split(name,"."){
+		if !token.IsIdentifier(part){
+			return fmt.Errorf("rpc server: %q is not a valid service name",name)
+		}
 	}
 	return nil
 }
 
 func Register(rcvr interface{})error{return DefaultServer.Register(rcvr)}
 
+func RegisterName(name string, rcvr interface{})error{return DefaultServer.RegisterName(name,rcvr)}
+
+func Unregister(name string)error{return DefaultServer.Unregister(name)}
+
+func UnregisterContext(ctx context.Context, name string)error{return DefaultServer.UnregisterContext(ctx,name)}
+
 // given a service method string find serice and method
 func(server *Server)findService(serviceMethod string)(svc *service,mType *methodType,err error){
 	// split string
 	dot := strings.LastIndex(serviceMethod,".")
 	if dot < 0{
-		err= errors.New("rpc server: service/method request is wrong formed")
+		err = Errorf(InvalidArgument,"rpc server: service/method request is wrong formed")
 		return
 	}
 	// get name
@@ -265,7 +782,7 @@ func(server *Server)findService(serviceMethod string)(svc *service,mType *method
 	//load service
 	svic,ok := server.serviceMap.Load(serviceName)
 	if !ok{
-		err = errors.New("rpc server: cannot find service")
+		err = Errorf(NotFound,"rpc server: cannot find service")
 		return
 	}
 	// parse service
@@ -274,7 +791,7 @@ func(server *Server)findService(serviceMethod string)(svc *service,mType *method
 	mType = svc.method[methodName]
 
 	if mType == nil{
-		err = errors.New("rpc server:cannot find method")
+		err = Errorf(NotFound,"rpc server:cannot find method")
 	}
 	return 
 }
@@ -0,0 +1,632 @@
+package gorpc
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"gorpc/codec"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// start a server on one end of a pipe and return a client on the other
+func newPipeClient(t *testing.T, server *Server, opt *Option) *Client {
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	opt, err := parseOptions(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(cli, opt)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+func TestFramingKeepsStreamAligned(t *testing.T) {
+	server := NewServer()
+	server.MaxFrameSize = 1024
+	var foo Foo
+	_ = server.Register(&foo)
+	client := newPipeClient(t, server, &Option{Framing: true})
+	_, ok := client.cc.(*codec.FrameCodec)
+	_assert(ok, "expect framed codec, got %T", client.cc)
+
+	ctx := context.Background()
+	var reply int
+	// body cannot be decoded into Args
+	err := client.Call(ctx, "Foo.Sum", "not args", &reply)
+	_assert(err != nil, "expect decode error")
+	// connection still usable afterwards
+	err = client.Call(ctx, "Foo.Unknown", &Args{}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "cannot find method"), "expect unknown method error, got %v", err)
+	// body over the frame limit is not drained, the server hangs up instead
+	err = client.Call(ctx, "Foo.Sum", strings.Repeat("x", 2048), &reply)
+	_assert(err != nil, "expect frame size error")
+	err = client.Call(ctx, "Foo.Sum", &Args{}, &reply)
+	_assert(CodeOf(err) == Unavailable, "expect closed connection, got %v", err)
+}
+
+// Blob replies with n bytes
+type Blob int
+
+func (b Blob) Make(n int, reply *string) error {
+	*reply = strings.Repeat("x", n)
+	return nil
+}
+
+func TestReplyTooLarge(t *testing.T) {
+	server := NewServer()
+	server.MaxFrameSize = 1024
+	var blob Blob
+	_ = server.Register(&blob)
+	client := newPipeClient(t, server, &Option{Framing: true})
+
+	var reply string
+	err := client.Call(context.Background(), "Blob.Make", 2048, &reply)
+	_assert(CodeOf(err) == ResourceExhausted, "expect ResourceExhausted for a reply over the limit, got %v", err)
+	err = client.Call(context.Background(), "Blob.Make", 10, &reply)
+	_assert(err == nil && len(reply) == 10, "expect connection to stay usable, got %v", err)
+}
+
+func TestClientMaxFrameSize(t *testing.T) {
+	server := NewServer()
+	var blob Blob
+	_ = server.Register(&blob)
+	client := newPipeClient(t, server, &Option{Framing: true, MaxFrameSize: 1024})
+
+	// arguments over the client's limit are refused before anything is sent
+	var reply string
+	err := client.Call(context.Background(), "Blob.Make", strings.Repeat("x", 2048), &reply)
+	_assert(CodeOf(err) == ResourceExhausted, "expect ResourceExhausted for args over the limit, got %v", err)
+	err = client.Call(context.Background(), "Blob.Make", 10, &reply)
+	_assert(err == nil && len(reply) == 10, "expect connection to stay usable, got %v", err)
+	// replies over it are not read
+	err = client.Call(context.Background(), "Blob.Make", 2048, &reply)
+	_assert(err != nil, "expect a reply over the client's limit to fail")
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	// asking for compression implies framing
+	client := newPipeClient(t, server, &Option{Compression: "gzip", CompressThreshold: 1})
+	_, ok := client.cc.(*codec.FrameCodec)
+	_assert(ok, "expect framed codec, got %T", client.cc)
+
+	var reply int
+	err := client.Call(context.Background(), "Foo.Unknown", &Args{}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "cannot find method"), "expect unknown method error, got %v", err)
+}
+
+type Tenant int
+
+// echo the tenant back through the reply and the trailer
+func (t Tenant) Check(ctx context.Context, args Args, reply *string) error {
+	md, _ := IncomingMetadata(ctx)
+	_ = SetTrailer(ctx, Metadata{"served-for": md.Get("tenant")})
+	*reply = "tenant " + md.Get("tenant")
+	return nil
+}
+
+func TestMetadata(t *testing.T) {
+	server := NewServer()
+	var tenant Tenant
+	_ = server.Register(&tenant)
+	client := newPipeClient(t, server, nil)
+
+	var trailer Metadata
+	ctx := NewOutgoingContext(context.Background(), Metadata{"tenant": "t1"})
+	ctx = WithTrailer(ctx, &trailer)
+	var reply string
+	err := client.Call(ctx, "Tenant.Check", Args{}, &reply)
+	_assert(err == nil && reply == "tenant t1", "expect metadata to reach handler, got %q, %v", reply, err)
+	_assert(trailer.Get("served-for") == "t1", "expect trailer, got %v", trailer)
+}
+
+// fail with a structured error picked by the caller
+func (t Tenant) Fail(args Args, reply *string) error {
+	if args.Num1 == 0 {
+		return errors.New("100% plain")
+	}
+	return &Error{Code: Code(args.Num1), Message: "tenant is gone", Details: map[string]string{"tenant": "t1"}}
+}
+
+func TestStructuredErrors(t *testing.T) {
+	server := NewServer()
+	var tenant Tenant
+	_ = server.Register(&tenant)
+	client := newPipeClient(t, server, nil)
+	ctx := context.Background()
+	var reply string
+
+	err := client.Call(ctx, "Tenant.Fail", Args{Num1: int(Unavailable)}, &reply)
+	var e *Error
+	_assert(errors.As(err, &e), "expect *Error, got %T", err)
+	_assert(e.Code == Unavailable && e.Message == "tenant is gone" && e.Details["tenant"] == "t1", "unexpected error %+v", e)
+
+	// plain errors keep their text, including % signs
+	err = client.Call(ctx, "Tenant.Fail", Args{}, &reply)
+	_assert(CodeOf(err) == Unknown && err.Error() == "100% plain", "unexpected error %v", err)
+
+	err = client.Call(ctx, "Tenant.Missing", Args{}, &reply)
+	_assert(CodeOf(err) == NotFound, "expect NotFound, got %v", CodeOf(err))
+	err = client.Call(ctx, "Tenant", Args{}, &reply)
+	_assert(CodeOf(err) == InvalidArgument, "expect InvalidArgument, got %v", CodeOf(err))
+}
+
+// Waiter blocks until its context ends and reports why
+type Waiter chan error
+
+func (w Waiter) Wait(ctx context.Context, args Args, reply *int) error {
+	<-ctx.Done()
+	w <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestHandlerContextCancelled(t *testing.T) {
+	server := NewServer()
+	w := make(Waiter, 1)
+	_ = server.Register(w)
+
+	// handle timeout expires the handler's context
+	client := newPipeClient(t, server, &Option{HandleTimeout: 50 * time.Millisecond})
+	var reply int
+	err := client.Call(context.Background(), "Waiter.Wait", Args{}, &reply)
+	_assert(CodeOf(err) == DeadlineExceeded, "expect DeadlineExceeded, got %v", err)
+	_assert(<-w == context.DeadlineExceeded, "expect handler context to expire")
+
+	// dropping the connection cancels it
+	client = newPipeClient(t, server, nil)
+	_ = client.Go("Waiter.Wait", Args{}, &reply, nil)
+	time.Sleep(50 * time.Millisecond)
+	_ = client.Close()
+	select {
+	case err := <-w:
+		_assert(err == context.Canceled, "expect handler context to be cancelled, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("handler context not cancelled after the connection closed")
+	}
+}
+
+// report how long the handler has until the client's deadline
+func (t Tenant) Deadline(ctx context.Context, args Args, reply *time.Duration) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return Errorf(InvalidArgument, "no deadline")
+	}
+	*reply = time.Until(deadline)
+	return nil
+}
+
+func TestClientCancelPropagates(t *testing.T) {
+	server := NewServer()
+	w := make(Waiter, 1)
+	var tenant Tenant
+	_ = server.Register(w)
+	_ = server.Register(&tenant)
+	client := newPipeClient(t, server, nil)
+	var reply int
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err := client.Call(ctx, "Waiter.Wait", Args{}, &reply)
+	_assert(CodeOf(err) == Canceled, "expect Canceled, got %v", err)
+	select {
+	case err := <-w:
+		_assert(err == context.Canceled, "expect handler to be cancelled, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("cancellation did not reach the handler")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var left time.Duration
+	err = client.Call(ctx, "Tenant.Deadline", Args{}, &left)
+	_assert(err == nil && left > 0 && left <= time.Minute, "expect deadline to reach handler, got %v, %v", left, err)
+	err = client.Call(context.Background(), "Tenant.Deadline", Args{}, &left)
+	_assert(CodeOf(err) == InvalidArgument, "expect no deadline without one on ctx, got %v", err)
+
+	// the time left travels, not the client's clock, so the deadline holds whatever the server's clock says
+	conn, cc := newRawConn(t, server, 0)
+	_assert(cc.Write(&codec.Header{ServiceMethod: "Tenant.Deadline", Seq: 1, Timeout: int64(time.Hour)}, Args{}) == nil, "failed to write request")
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	var h codec.Header
+	_assert(cc.ReadHeader(&h) == nil && h.Error == "", "unexpected response %+v", h)
+	_assert(cc.ReadBody(&left) == nil, "failed to read reply")
+	_assert(left > 59*time.Minute && left <= time.Hour, "expect about an hour left, got %v", left)
+}
+
+func TestInterceptors(t *testing.T) {
+	server := NewServer()
+	var tenant Tenant
+	_ = server.Register(&tenant)
+	var order []string
+	server.Use(func(ctx context.Context, info *MethodInfo, args, reply interface{}, next Handler) error {
+		order = append(order, "first")
+		return next(ctx, args, reply)
+	}, func(ctx context.Context, info *MethodInfo, args, reply interface{}, next Handler) error {
+		order = append(order, "second")
+		if info.Method == "Check" {
+			// stop the call before it reaches the handler
+			return Errorf(PermissionDenied, "denied %s", info.FullMethod())
+		}
+		return next(ctx, args, reply)
+	})
+	client := newPipeClient(t, server, nil)
+
+	var reply string
+	err := client.Call(context.Background(), "Tenant.Check", Args{}, &reply)
+	_assert(CodeOf(err) == PermissionDenied && err.Error() == "denied Tenant.Check", "expect interceptor error, got %v", err)
+	_assert(len(order) == 2 && order[0] == "first" && order[1] == "second", "unexpected order %v", order)
+
+	// calls passing every interceptor reach the handler
+	err = client.Call(context.Background(), "Tenant.Slow", Args{}, &reply)
+	_assert(err == nil && reply == "slow done", "expect handler reply, got %q, %v", reply, err)
+}
+
+// take a while before replying
+func (t Tenant) Slow(args Args, reply *string) error {
+	time.Sleep(time.Duration(args.Num1) * time.Millisecond)
+	*reply = "slow done"
+	return nil
+}
+
+func TestShutdownDrains(t *testing.T) {
+	server := NewServer()
+	var tenant Tenant
+	_ = server.Register(&tenant)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	call := client.Go("Tenant.Slow", Args{Num1: 200}, &reply, nil)
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_assert(server.Shutdown(ctx) == nil, "expect shutdown to finish")
+
+	// running call completed normally
+	call = <-call.Done
+	_assert(call.Error == nil && reply == "slow done", "expect in-flight call to finish, got %q, %v", reply, call.Error)
+	_assert(!client.IsAvailable(), "expect client to stop sending after go away")
+	err = client.Call(context.Background(), "Tenant.Slow", Args{}, &reply)
+	_assert(CodeOf(err) == Unavailable, "expect Unavailable, got %v", err)
+	_, err = Dial("tcp", l.Addr().String())
+	_assert(err != nil, "expect listener to be closed")
+}
+
+func TestShutdownForceCloses(t *testing.T) {
+	server := NewServer()
+	w := make(Waiter, 1)
+	_ = server.Register(w)
+	client := newPipeClient(t, server, nil)
+	var reply int
+	_ = client.Go("Waiter.Wait", Args{}, &reply, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	_assert(err == context.DeadlineExceeded, "expect shutdown to give up, got %v", err)
+	_assert(<-w == context.Canceled, "expect handler to be cancelled")
+}
+
+func (t Tenant) Panic(args Args, reply *string) error {
+	var m map[string]int
+	m["boom"] = 1
+	return nil
+}
+
+func TestPanicRecovered(t *testing.T) {
+	server := NewServer()
+	var tenant Tenant
+	_ = server.Register(&tenant)
+	client := newPipeClient(t, server, nil)
+
+	var reply string
+	err := client.Call(context.Background(), "Tenant.Panic", Args{}, &reply)
+	_assert(CodeOf(err) == Internal && strings.Contains(err.Error(), "panicked"), "expect Internal error, got %v", err)
+	_, mType, _ := server.findService("Tenant.Panic")
+	_assert(mType.NumPanics() == 1, "expect panic to be counted, got %d", mType.NumPanics())
+
+	// the server survived and keeps serving the connection
+	err = client.Call(context.Background(), "Tenant.Slow", Args{}, &reply)
+	_assert(err == nil && reply == "slow done", "expect the connection to keep serving, got %v", err)
+}
+
+// dial the server over a pipe speaking the raw gob codec, so tests can see every message
+func newRawConn(t *testing.T, server *Server, handleTimeout time.Duration) (net.Conn, codec.Codec) {
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	t.Cleanup(func() { _ = cli.Close() })
+	opt := &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, HandleTimeout: handleTimeout}
+	_assert(writeJSON(cli, opt) == nil, "failed to write option")
+	var reply handshakeReply
+	_assert(json.NewDecoder(cli).Decode(&reply) == nil && reply.Error == "", "handshake failed: %+v", reply)
+	return cli, codec.NewGobCodec(cli)
+}
+
+// read exactly one response for seq and make sure nothing else follows
+func expectOneResponse(t *testing.T, conn net.Conn, cc codec.Codec, seq uint64, wait time.Duration) codec.Header {
+	var h codec.Header
+	_assert(cc.ReadHeader(&h) == nil, "failed to read response header")
+	_assert(h.Seq == seq, "expect response for seq %d, got %d", seq, h.Seq)
+	_assert(cc.ReadBody(nil) == nil, "failed to read response body")
+
+	_ = conn.SetReadDeadline(time.Now().Add(wait))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	var extra codec.Header
+	err := cc.ReadHeader(&extra)
+	_assert(err != nil, "unexpected second response %+v", extra)
+	return h
+}
+
+func TestResponseLifecycle(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	var tenant Tenant
+	_ = server.Register(&foo)
+	_ = server.Register(&tenant)
+
+	cases := []struct {
+		name    string
+		method  string
+		args    Args
+		timeout time.Duration
+		code    Code
+	}{
+		{"success", "Foo.Sum", Args{Num1: 1, Num2: 2}, 0, OK},
+		{"failure", "Tenant.Fail", Args{}, 0, Unknown},
+		{"panic", "Tenant.Panic", Args{}, 0, Internal},
+		{"unknown method", "Tenant.Missing", Args{}, 0, NotFound},
+		{"timeout", "Tenant.Slow", Args{Num1: 200}, 50 * time.Millisecond, DeadlineExceeded},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn, cc := newRawConn(t, server, c.timeout)
+			_assert(cc.Write(&codec.Header{ServiceMethod: c.method, Seq: 1}, c.args) == nil, "failed to write request")
+			// wait past the slow handler, so a late second response would show up
+			h := expectOneResponse(t, conn, cc, 1, 300*time.Millisecond)
+			_assert(Code(h.Code) == c.code, "expect %v, got %v (%s)", c.code, Code(h.Code), h.Error)
+		})
+	}
+}
+
+func TestUnexpectedKindClosesConn(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	for _, kind := range []codec.Kind{codec.KindGoAway, codec.KindCallback, codec.Kind(200)} {
+		conn, cc := newRawConn(t, server, 0)
+		_assert(cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1, Kind: kind}, Args{}) == nil, "failed to write kind %d", kind)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		var h codec.Header
+		err := cc.ReadHeader(&h)
+		_assert(err != nil && !errors.Is(err, os.ErrDeadlineExceeded), "expect kind %d to close the connection, got %+v, %v", kind, h, err)
+	}
+}
+
+func TestCallSucceedsOverEveryCodec(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	opts := map[string]*Option{
+		"gob":             {CodecType: codec.GobType},
+		"json":            {CodecType: codec.JsonType},
+		"msgpack":         {CodecType: codec.MsgpackType},
+		"gob framed":      {CodecType: codec.GobType, Framing: true},
+		"json gzip":       {CodecType: codec.JsonType, Compression: "gzip", CompressThreshold: 1},
+		"msgpack deflate": {CodecType: codec.MsgpackType, Compression: "deflate"},
+	}
+	for name, opt := range opts {
+		t.Run(name, func(t *testing.T) {
+			client := newPipeClient(t, server, opt)
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					var reply int
+					err := client.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: i * i}, &reply)
+					_assert(err == nil && reply == i+i*i, "call %d: got %d, %v", i, reply, err)
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// Shard tells which instance answered
+type Shard struct{ ID int }
+
+func (s *Shard) Which(args Args, reply *int) error {
+	*reply = s.ID
+	return nil
+}
+
+// Gate holds calls until it is closed
+type Gate chan struct{}
+
+func (g Gate) Pass(args Args, reply *int) error {
+	<-g
+	*reply = 1
+	return nil
+}
+
+// ProtoPair is a hand written stand-in for a generated message: int64 a = 1; int64 b = 2;
+type ProtoPair struct {
+	A, B int64
+}
+
+func (m *ProtoPair) Marshal() ([]byte, error) {
+	var b []byte
+	if m.A != 0 {
+		b = binary.AppendUvarint(append(b, 1<<3), uint64(m.A))
+	}
+	if m.B != 0 {
+		b = binary.AppendUvarint(append(b, 2<<3), uint64(m.B))
+	}
+	return b, nil
+}
+
+func (m *ProtoPair) Unmarshal(data []byte) error {
+	*m = ProtoPair{}
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 || tag&7 != 0 {
+			return errors.New("proto pair: bad tag")
+		}
+		u, k := binary.Uvarint(data[n:])
+		if k <= 0 {
+			return errors.New("proto pair: bad varint")
+		}
+		data = data[n+k:]
+		switch tag >> 3 {
+		case 1:
+			m.A = int64(u)
+		case 2:
+			m.B = int64(u)
+		}
+	}
+	return nil
+}
+
+// Adder speaks protobuf messages only
+type Adder int
+
+func (a Adder) Add(args ProtoPair, reply *ProtoPair) error {
+	reply.A = args.A + args.B
+	return nil
+}
+
+func (a Adder) AddPtr(args *ProtoPair, reply *ProtoPair) error {
+	reply.A = args.A + args.B
+	return nil
+}
+
+func (a Adder) Fail(args ProtoPair, reply *ProtoPair) error {
+	return &Error{Code: PermissionDenied, Message: "no sums today", Details: map[string]string{"a": "1"}}
+}
+
+func TestProtobufCalls(t *testing.T) {
+	server := NewServer()
+	var adder Adder
+	_ = server.Register(&adder)
+	opts := map[string]*Option{
+		"protobuf":        {CodecType: codec.ProtobufType},
+		"protobuf framed": {CodecType: codec.ProtobufType, Framing: true},
+		"protobuf gzip":   {CodecType: codec.ProtobufType, Compression: "gzip", CompressThreshold: 1},
+	}
+	for name, opt := range opts {
+		t.Run(name, func(t *testing.T) {
+			client := newPipeClient(t, server, opt)
+			ctx := context.Background()
+			var reply ProtoPair
+			err := client.Call(ctx, "Adder.Add", ProtoPair{A: 2, B: 3}, &reply)
+			_assert(err == nil && reply.A == 5, "expect 5 for value args, got %+v, %v", reply, err)
+			err = client.Call(ctx, "Adder.AddPtr", &ProtoPair{A: 4, B: -1}, &reply)
+			_assert(err == nil && reply.A == 3, "expect 3 for pointer args, got %+v, %v", reply, err)
+
+			err = client.Call(ctx, "Adder.Fail", ProtoPair{}, &reply)
+			var e *Error
+			_assert(errors.As(err, &e) && e.Code == PermissionDenied && e.Message == "no sums today" && e.Details["a"] == "1",
+				"expect structured error, got %#v", err)
+			// the connection carries on after the error
+			err = client.Call(ctx, "Adder.Add", &ProtoPair{A: 1}, &reply)
+			_assert(err == nil && reply.A == 1, "expect 1 after an error, got %+v, %v", reply, err)
+		})
+	}
+}
+
+func TestRegisterName(t *testing.T) {
+	server := NewServer()
+	_assert(server.RegisterName("shard.v1.One", &Shard{ID: 1}) == nil, "failed to register shard one")
+	_assert(server.RegisterName("shard.v1.Two", &Shard{ID: 2}) == nil, "failed to register shard two")
+	_assert(server.RegisterName("shard.v1.Two", &Shard{ID: 3}) != nil, "expect duplicate name to fail")
+	for _, name := range []string{"", "shard..Two", "shard.v1.", "1shard"} {
+		_assert(server.RegisterName(name, &Shard{}) != nil, "expect name %q to be rejected", name)
+	}
+
+	client := newPipeClient(t, server, nil)
+	for want, method := range map[int]string{1: "shard.v1.One.Which", 2: "shard.v1.Two.Which"} {
+		var id int
+		err := client.Call(context.Background(), method, Args{}, &id)
+		_assert(err == nil && id == want, "expect %s to answer %d, got %d, %v", method, want, id, err)
+	}
+}
+
+func TestUnregisterDrains(t *testing.T) {
+	server := NewServer()
+	g := make(Gate)
+	_ = server.RegisterName("Gate", g)
+	client := newPipeClient(t, server, nil)
+	var reply int
+	call := client.Go("Gate.Pass", Args{}, &reply, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	unregistered := make(chan error)
+	go func() { unregistered <- server.Unregister("Gate") }()
+	select {
+	case <-unregistered:
+		t.Fatal("expect Unregister to wait for the running call")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// new calls no longer find the service
+	err := client.Call(context.Background(), "Gate.Pass", Args{}, &reply)
+	_assert(CodeOf(err) == NotFound, "expect NotFound after Unregister, got %v", err)
+
+	close(g)
+	_assert(<-unregistered == nil, "failed to unregister")
+	<-call.Done
+	_assert(call.Error == nil && reply == 1, "expect running call to finish, got %v", call.Error)
+	_assert(CodeOf(server.Unregister("Gate")) == NotFound, "expect unknown service to fail")
+}
+
+// Retire tries to unregister its own service from inside a call
+type Retire struct{ server *Server }
+
+func (r *Retire) Self(ctx context.Context, args Args, reply *int) error {
+	return r.server.UnregisterContext(ctx, "Retire")
+}
+
+func TestUnregisterFromOwnMethod(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(&Retire{server: server})
+	g := make(Gate)
+	_ = server.RegisterName("Gate", g)
+	client := newPipeClient(t, server, nil)
+
+	// refused rather than waiting for itself, and the service stays
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var reply int
+	err := client.Call(ctx, "Retire.Self", Args{}, &reply)
+	_assert(CodeOf(err) == InvalidArgument, "expect InvalidArgument, got %v", err)
+	err = client.Call(ctx, "Retire.Self", Args{}, &reply)
+	_assert(CodeOf(err) == InvalidArgument, "expect the service to stay registered, got %v", err)
+	_assert(server.Unregister("Retire") == nil, "failed to unregister from outside")
+
+	// the wait gives up with ctx, the service is gone regardless
+	call := client.Go("Gate.Pass", Args{}, &reply, nil)
+	time.Sleep(50 * time.Millisecond)
+	wait, cancelWait := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelWait()
+	_assert(server.UnregisterContext(wait, "Gate") == context.DeadlineExceeded, "expect the wait to time out")
+	err = client.Call(context.Background(), "Gate.Pass", Args{}, &reply)
+	_assert(CodeOf(err) == NotFound, "expect NotFound after Unregister, got %v", err)
+	close(g)
+	<-call.Done
+	_assert(call.Error == nil, "expect running call to finish, got %v", call.Error)
+}
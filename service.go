@@ -1,9 +1,15 @@
 package gorpc
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"go/ast"
+	"gorpc/codec"
 	"log"
 	"reflect"
+	"strings"
+	"sync"
 	"sync/atomic"
 )
 
@@ -12,13 +18,32 @@ type methodType struct{
 	method reflect.Method // method name
 	ArgType reflect.Type // argument type
 	ReplyType reflect.Type // return vla type
+	hasContext bool // method takes a context.Context before its arguments
+	stream bool // method sends its replies through a ServerStream
+	recv bool // method reads client messages from a receive channel
 	numCalls uint64 // we can static the number of calls
+	numPanics uint64 // calls that ended in a recovered panic
 }
 
 func(m *methodType)NumCalls()uint64{
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+func(m *methodType)NumPanics()uint64{
+	return atomic.LoadUint64(&m.numPanics)
+}
+
+// the kind of request that calls the method
+func(m *methodType)kind()codec.Kind{
+	switch{
+	case m.recv:
+		return codec.KindClientStream
+	case m.stream:
+		return codec.KindStream
+	}
+	return codec.KindCall
+}
+
 // internal method to create new method type
 func(m *methodType)newArgv()reflect.Value{
 	var argv reflect.Value
@@ -46,67 +71,211 @@ func(m *methodType)newReplyv()reflect.Value{
 
 // each struct will create a service
 type service struct{
-	name string // name of the struct
+	name string // name the service is registered under, the struct's name by default
 	typ reflect.Type // type of the struct
 	rcvr reflect.Value // object itself
 	method map[string]*methodType // every function of the struct
+	mu sync.Mutex // protect following
+	calls sync.WaitGroup // calls still running, so Unregister can drain them
+	closed bool // unregistered, no new calls start
+}
+
+// SkippedMethod is an exported method that could not be published, and why
+type SkippedMethod struct{
+	Name string
+	Reason string
+}
+
+// RegisterError is returned when a service has no usable methods, or in strict mode
+// when some of its exported methods have the wrong shape
+type RegisterError struct{
+	Service string
+	Skipped []SkippedMethod
+	NoMethods bool // nothing could be published
+}
+
+func (e *RegisterError)Error()string{
+	var b strings.Builder
+	if e.NoMethods{
+		fmt.Fprintf(&b,"rpc server: service %s has no usable methods",e.Service)
+	}else{
+		fmt.Fprintf(&b,"rpc server: service %s has methods that cannot be published",e.Service)
+	}
+	for _, m := range e.Skipped{
+		fmt.Fprintf(&b,"; %s: %s",m.Name,m.Reason)
+	}
+	return b.String()
+}
+
+// create a new service named after the struct
+func newService(rcvr interface{})(*service,error){
+	return newNamedService("",rcvr,false)
 }
 
-// create a new service
-func newService(rcvr interface{})*service{
+// create a new service registered under name, an empty name means the struct's name.
+// strict fails when any exported method is skipped
+func newNamedService(name string, rcvr interface{}, strict bool)(*service,error){
+	if rcvr == nil{
+		return nil, errors.New("rpc server: cannot register a nil receiver")
+	}
 	s := new(service)
 
 	s.rcvr = reflect.ValueOf(rcvr)
-	s.name = reflect.Indirect(s.rcvr).Type().Name()
+	s.name = name
+	if s.name == ""{
+		s.name = reflect.Indirect(s.rcvr).Type().Name()
+		if s.name == ""{
+			return nil, fmt.Errorf("rpc server: no service name for type %s, use RegisterName",s.rcvr.Type())
+		}
+		if !ast.IsExported(s.name){
+			return nil, fmt.Errorf("rpc server: type %s is not exported, use RegisterName",s.name)
+		}
+	}
 
 	s.typ = reflect.TypeOf(rcvr)
-	if !ast.IsExported(s.name){
-		log.Fatalf("rpc server: %s is not a valid service name",s.name)
-	}
 	// register all method into service
-	s.registerMethod()
-	return s
+	skipped := s.registerMethod()
+	for _, m := range skipped{
+		log.Printf("rpc server: skip %s.%s: %s\n",s.name,m.Name,m.Reason)
+	}
+	if len(s.method) == 0{
+		return nil, &RegisterError{Service: s.name,Skipped: skipped,NoMethods: true}
+	}
+	if strict && len(skipped) > 0{
+		return nil, &RegisterError{Service: s.name,Skipped: skipped}
+	}
+	return s,nil
 }
 
-// register method into service
-func(s* service)registerMethod(){
+// register method into service, returning the exported methods that were left out
+func(s* service)registerMethod()[]SkippedMethod{
 	s.method = make(map[string]*methodType)
+	var skipped []SkippedMethod
 	for i := 0;i < s.typ.NumMethod();i++{
 		method := s.typ.Method(i)
-		mType := method.Type
-		// check every method in current struct
-		// in reflect first in is itself
-		if mType.NumIn() != 3 || mType.NumOut() != 1{
-			continue;
-		}
-		// one out must be error
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem(){
-			continue;
-		}
-		// two arg, both with built in type of exported type
-		argType, replyType := mType.In(1), mType.In(2)
-		if !isExportedOrBuiltInType(argType) || ! isExportedOrBuiltInType(replyType){
+		mt, reason := checkMethod(method)
+		if mt == nil{
+			skipped = append(skipped,SkippedMethod{Name: method.Name,Reason: reason})
 			continue
 		}
-		s.method[method.Name] = &methodType{
+		s.method[method.Name] = mt
+		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
+	}
+	return skipped
+}
+
+// check the shape of a method, returning why it cannot be published when it is wrong
+func checkMethod(method reflect.Method)(*methodType,string){
+	mType := method.Type
+	// check every method in current struct
+	// in reflect first in is itself, an optional context.Context may come next
+	hasContext := mType.NumIn() == 4 && mType.In(1) == typeOfContext
+	if mType.NumIn() != 3 && !hasContext{
+		return nil, fmt.Sprintf("takes %d arguments, want (args, reply), (args, stream) or a ctx before them",mType.NumIn()-1)
+	}
+	// one out must be error
+	if mType.NumOut() != 1{
+		return nil, fmt.Sprintf("returns %d values, want a single error",mType.NumOut())
+	}
+	if mType.Out(0) != typeOfError{
+		return nil, fmt.Sprintf("returns %s, want error",mType.Out(0))
+	}
+	// two arg, both with built in type of exported type
+	argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
+	if !isExportedOrBuiltInType(argType){
+		return nil, fmt.Sprintf("argument type %s is not exported",argType)
+	}
+	// methods taking client messages read them from a receive channel
+	recv := argType.Kind() == reflect.Chan
+	if recv && argType.ChanDir() != reflect.RecvDir{
+		return nil, fmt.Sprintf("argument type %s must be a receive-only channel",argType)
+	}
+	if recv && !isExportedOrBuiltInType(argType.Elem()){
+		return nil, fmt.Sprintf("argument type %s is not exported",argType.Elem())
+	}
+	// streaming methods send their replies instead of filling one in
+	if replyType == typeOfServerStream{
+		return &methodType{
 			method:    method,
 			ArgType:   argType,
 			ReplyType: replyType,
-		}
-		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
+			hasContext: hasContext,
+			stream:    true,
+			recv:      recv,
+		},""
+	}
+	if replyType.Kind() != reflect.Ptr{
+		return nil, fmt.Sprintf("reply type %s is not a pointer",replyType)
 	}
+	if !isExportedOrBuiltInType(replyType){
+		return nil, fmt.Sprintf("reply type %s is not exported",replyType)
+	}
+	return &methodType{
+		method:    method,
+		ArgType:   argType,
+		ReplyType: replyType,
+		hasContext: hasContext,
+		recv:      recv,
+	},""
+}
+
+// account for a new call, false once the service was unregistered
+func(s *service)begin()bool{
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed{
+		return false
+	}
+	s.calls.Add(1)
+	return true
 }
 
+func(s *service)done(){
+	s.calls.Done()
+}
+
+// stop taking calls and wait for the running ones, or until ctx is done
+func(s *service)drain(ctx context.Context)error{
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func(){
+		s.calls.Wait()
+		close(done)
+	}()
+	select{
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var (
+	typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
 func isExportedOrBuiltInType(t reflect.Type)bool{
+	// a pointer type has no name of its own, look at what it points to
+	for t.Kind() == reflect.Ptr{
+		t = t.Elem()
+	}
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
 // this funtion will allow serivce to execute the function
-func(s *service)call(m *methodType, argv,replyv reflect.Value)error{
+// ctx is only handed to methods that ask for it
+func(s *service)call(ctx context.Context, m *methodType, argv,replyv reflect.Value)error{
 	atomic.AddUint64(&m.numCalls,1)
 
 	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.rcvr,argv,replyv})
+	in := []reflect.Value{s.rcvr,argv,replyv}
+	if m.hasContext{
+		in = []reflect.Value{s.rcvr,reflect.ValueOf(ctx),argv,replyv}
+	}
+	returnValues := f.Call(in)
 
 	if errInter := returnValues[0].Interface();errInter != nil{
 		return errInter.(error)
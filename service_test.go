@@ -1,8 +1,11 @@
 package gorpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -31,7 +34,7 @@ func _assert(condition bool, msg string, v ...interface{}) {
 
 func TestNewService(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, _ := newService(&foo)
 	 _assert(len(s.method) == 1,"wrong service method ,expect 1 but got %d",len(s.method))
 
 	 mType := s.method["Sum"]
@@ -40,15 +43,70 @@ func TestNewService(t *testing.T) {
 
 func TestMethodType_Call(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, _ := newService(&foo)
 	 mType := s.method["Sum"]
 
 	 argv := mType.newArgv()
 	 replyv := mType.newReplyv()
 
 	 argv.Set(reflect.ValueOf(Args{Num1: 1,Num2: 2}))
-	 err := s.call(mType,argv,replyv)
+	 err := s.call(context.Background(),mType,argv,replyv)
 	 
 	 _assert(err == nil && *replyv.Interface().(*int) == 3 && mType.NumCalls() == 1,"Function is not returning correct value")
 }
 
+
+// Mixed has one good method and a few with the wrong shape
+type Mixed int
+
+func(m Mixed)Good(args Args, reply *int)error{return nil}
+
+func(m Mixed)ValueReply(args Args, reply int)error{return nil}
+
+func(m Mixed)NoError(args Args, reply *int){}
+
+func(m Mixed)TooMany(a, b Args, reply *int)error{return nil}
+
+type hiddenReply struct{}
+
+func(m Mixed)HiddenReply(args Args, reply *hiddenReply)error{return nil}
+
+func(m Mixed)HiddenArgs(args *hidden, reply *int)error{return nil}
+
+type Broken int
+
+func(b Broken)ValueReply(args Args, reply int)error{return nil}
+
+type hidden int
+
+func(h hidden)Sum(args Args, reply *int)error{return nil}
+
+func TestRegisterErrors(t *testing.T) {
+	server := NewServer()
+	var mixed Mixed
+	_assert(server.Register(&mixed) == nil,"expect lenient register to skip bad methods")
+
+	var broken Broken
+	err := server.Register(&broken)
+	var re *RegisterError
+	_assert(errors.As(err,&re) && re.NoMethods && len(re.Skipped) == 1,"expect no usable methods error, got %v",err)
+	_assert(strings.Contains(err.Error(),"reply type int is not a pointer"),"expect reason in error, got %v",err)
+
+	var h hidden
+	_assert(server.Register(&h) != nil,"expect unexported type to fail")
+	_assert(server.RegisterName("Hidden",&h) == nil,"expect unexported type under a name to register")
+	_assert(server.Register(nil) != nil,"expect nil receiver to fail")
+
+	strict := NewServer()
+	strict.StrictRegister = true
+	err = strict.Register(&mixed)
+	_assert(errors.As(err,&re) && !re.NoMethods,"expect strict register to fail, got %v",err)
+	reasons := map[string]string{}
+	for _, m := range re.Skipped{
+		reasons[m.Name] = m.Reason
+	}
+	_assert(len(reasons) == 5 && reasons["ValueReply"] != "" && reasons["NoError"] != "" && reasons["TooMany"] != "","expect every bad method listed, got %v",re.Skipped)
+	_assert(reasons["HiddenReply"] == "reply type *gorpc.hiddenReply is not exported","expect unexported reply to be listed, got %q",reasons["HiddenReply"])
+	_assert(reasons["HiddenArgs"] == "argument type *gorpc.hidden is not exported","expect unexported argument to be listed, got %q",reasons["HiddenArgs"])
+	_assert(reasons["Good"] == "","expect good method not to be listed")
+}
@@ -0,0 +1,134 @@
+package gorpc
+
+import (
+	"context"
+	"gorpc/codec"
+	"log"
+	"net"
+	"sync"
+)
+
+// returned for requests that arrive after the server started shutting down
+var ErrServerClosed = Errorf(Unavailable,"rpc server: server is shutting down")
+
+// a connection being served, tracked so Shutdown can drain it
+type serverConn struct{
+	cc codec.Codec
+	sending *sync.Mutex // we want to send complete response
+	wg *sync.WaitGroup // requests still being handled
+	cancel context.CancelFunc // cancel every handler of the connection
+	mu sync.Mutex // protect following
+	draining bool // no new requests are started once set
+}
+
+// account for a new request, false once the connection is draining
+func (sc *serverConn)begin()bool{
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.draining{
+		return false
+	}
+	sc.wg.Add(1)
+	return true
+}
+
+// stop taking requests, tell the client, wait for running requests and close
+func (sc *serverConn)drain(){
+	sc.mu.Lock()
+	sc.draining = true
+	sc.mu.Unlock()
+
+	sc.sending.Lock()
+	if err := sc.cc.Write(&codec.Header{Kind: codec.KindGoAway},invalidRequest);err != nil{
+		log.Println("rpc server: send go away error:",err)
+	}
+	sc.sending.Unlock()
+
+	sc.wg.Wait()
+	_ = sc.cc.Close()
+}
+
+// add or remove a connection, adding fails once the server is shutting down
+func (server *Server)trackConn(sc *serverConn, add bool)bool{
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add{
+		delete(server.conns,sc)
+		return true
+	}
+	if server.inShutdown{
+		return false
+	}
+	if server.conns == nil{
+		server.conns = make(map[*serverConn]struct{})
+	}
+	server.conns[sc] = struct{}{}
+	return true
+}
+
+// add or remove a listener, adding fails once the server is shutting down
+func (server *Server)trackListener(lis net.Listener, add bool)bool{
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add{
+		delete(server.listeners,lis)
+		return true
+	}
+	if server.inShutdown{
+		return false
+	}
+	if server.listeners == nil{
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+func (server *Server)shuttingDown()bool{
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.inShutdown
+}
+
+// Shutdown stops accepting connections, asks connected clients to stop sending
+// and waits for running requests to finish before closing each connection.
+// once ctx is done the remaining connections are closed and their handlers cancelled
+func (server *Server)Shutdown(ctx context.Context)error{
+	server.mu.Lock()
+	server.inShutdown = true
+	for lis := range server.listeners{
+		_ = lis.Close()
+	}
+	conns := make([]*serverConn,0,len(server.conns))
+	for sc := range server.conns{
+		conns = append(conns, sc)
+	}
+	server.mu.Unlock()
+
+	done := make(chan struct{})
+	go func(){
+		var wg sync.WaitGroup
+		for _, sc := range conns{
+			wg.Add(1)
+			go func(sc *serverConn){
+				defer wg.Done()
+				sc.drain()
+			}(sc)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select{
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, sc := range conns{
+			sc.cancel()
+			_ = sc.cc.Close()
+		}
+		return ctx.Err()
+	}
+}
+
+func Shutdown(ctx context.Context)error{return DefaultServer.Shutdown(ctx)}
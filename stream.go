@@ -0,0 +1,576 @@
+package gorpc
+
+import (
+	"context"
+	"gorpc/codec"
+	"log"
+	"reflect"
+	"sync"
+)
+
+// DefaultStreamWindow is how many messages each side of a stream may have in flight
+// before it waits for the other side to take them
+const DefaultStreamWindow = 64
+
+// ServerStream is handed to streaming methods to send any number of replies for one request,
+// M(args, stream ServerStream) error, or M(in <-chan T, stream ServerStream) error when the
+// client streams as well. returning from the method ends the stream
+type ServerStream interface{
+	// the request's context, done once the client cancels or goes away
+	Context() context.Context
+	// send one reply, waiting while the client is a full window behind. it fails once the stream is over
+	Send(reply interface{})error
+}
+
+var typeOfServerStream = reflect.TypeOf((*ServerStream)(nil)).Elem()
+
+// returned when sending on a stream that ended, or that the sender closed
+var ErrStreamClosed = Errorf(Canceled,"rpc: stream is closed")
+
+// flow control credit of one direction of a stream, counted in messages
+type window struct{
+	mu sync.Mutex
+	credit int
+	more chan struct{} // poked when credit grows
+}
+
+func newWindow(n int)*window{
+	return &window{credit: n,more: make(chan struct{},1)}
+}
+
+// wait for one message worth of credit, false once done is closed
+func (w *window)take(done <-chan struct{})bool{
+	for{
+		w.mu.Lock()
+		if w.credit > 0{
+			w.credit--
+			left := w.credit
+			w.mu.Unlock()
+			// let the next waiting sender in
+			if left > 0{
+				w.poke()
+			}
+			return true
+		}
+		w.mu.Unlock()
+		select{
+		case <-w.more:
+		case <-done:
+			return false
+		}
+	}
+}
+
+func (w *window)add(n int){
+	w.mu.Lock()
+	w.credit += n
+	w.mu.Unlock()
+	w.poke()
+}
+
+func (w *window)poke(){
+	select{
+	case w.more <- struct{}{}:
+	default:
+	}
+}
+
+// count a message the receiver took, returning the credit to hand back once half a window built up
+func creditDue(consumed *int, size int)int{
+	*consumed++
+	if *consumed < (size+1)/2{
+		return 0
+	}
+	n := *consumed
+	*consumed = 0
+	return n
+}
+
+// the window the opener asked for, it applies to both directions
+func streamWindow(n uint32)int{
+	if n == 0{
+		return DefaultStreamWindow
+	}
+	return int(n)
+}
+
+// make a value of type t to decode into, returning it and the pointer to pass to ReadBody
+func newElem(t reflect.Type)(reflect.Value,interface{}){
+	if t.Kind() == reflect.Ptr{
+		p := reflect.New(t.Elem())
+		return p,p.Interface()
+	}
+	p := reflect.New(t)
+	return p.Elem(),p.Interface()
+}
+
+// server side of a stream, every message carries the Seq of the request that opened it
+type serverStream struct{
+	cc codec.Codec
+	h codec.Header // header of the messages we send
+	sending *sync.Mutex
+	size int // window of both directions
+	sendWin *window
+	abortReq context.CancelFunc // cancel the request when the stream itself fails
+	ctx context.Context // the handler's context, set by start
+	in reflect.Value // unbuffered chan handed to methods taking client messages
+	inReady chan struct{} // poked when a client message arrives or the client is done sending
+	mu sync.Mutex // protect following, held while sending so nothing follows the final response
+	closed bool
+	err error // why the stream failed on our side, answered instead of the handler's result
+	queue []reflect.Value // client messages the method has not taken yet
+	inEnd bool // client is done sending
+	consumed int
+}
+
+// the window is what the client asked for, up to max. it bounds the queue of client messages
+func newServerStream(cc codec.Codec, req *request, sending *sync.Mutex, cancel context.CancelFunc, max int)*serverStream{
+	if max <= 0{
+		max = DefaultStreamWindow
+	}
+	s := &serverStream{
+		cc: cc,
+		h: codec.Header{ServiceMethod: req.h.ServiceMethod,Seq: req.h.Seq,Kind: codec.KindStreamMsg},
+		sending: sending,
+		size: streamWindow(req.h.Window),
+		abortReq: cancel,
+		inReady: make(chan struct{},1),
+	}
+	if s.size > max{
+		s.size = max
+	}
+	s.sendWin = newWindow(s.size)
+	if req.mtype.recv{
+		s.in = reflect.MakeChan(reflect.ChanOf(reflect.BothDir,req.mtype.ArgType.Elem()),0)
+	}
+	return s
+}
+
+// the request is being handled, client messages can flow to the method.
+// the client learns the window we settled on before any message of ours
+func (s *serverStream)start(ctx context.Context){
+	s.ctx = ctx
+	h := &codec.Header{Seq: s.h.Seq,Kind: codec.KindWindowUpdate,Window: uint32(s.size)}
+	if err := s.write(h,invalidRequest);err != nil{
+		log.Println("rpc server: send stream window error:",err)
+	}
+	if s.in.IsValid(){
+		go s.pump()
+	}
+}
+
+func (s *serverStream)Context()context.Context{
+	return s.ctx
+}
+
+func (s *serverStream)Send(reply interface{})error{
+	if !s.sendWin.take(s.ctx.Done()){
+		return Errorf(CodeOf(s.ctx.Err()),"rpc server: stream ended: %v",s.ctx.Err())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed{
+		return ErrStreamClosed
+	}
+	if err := s.ctx.Err();err != nil{
+		return Errorf(CodeOf(err),"rpc server: stream ended: %v",err)
+	}
+	h := s.h
+	return s.write(&h,reply)
+}
+
+// the single reply of a client-streaming method goes out as a stream message before the final response
+func (s *serverStream)sendReply(reply interface{})error{
+	h := s.h
+	return s.write(&h,reply)
+}
+
+func (s *serverStream)write(h *codec.Header, body interface{})error{
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	return s.cc.Write(h,body)
+}
+
+// no more messages once the final response is about to go out
+func (s *serverStream)close(){
+	if s == nil{
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+// fail this stream only, the connection and other calls carry on
+func (s *serverStream)fail(err error){
+	s.mu.Lock()
+	if s.err == nil{
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.abortReq()
+}
+
+func (s *serverStream)failure()error{
+	if s == nil{
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// read one client message into the queue, a message that cannot be decoded or
+// that overruns the window fails the stream
+func (s *serverStream)receive(cc codec.Codec){
+	if !s.in.IsValid(){
+		_ = cc.ReadBody(nil)
+		s.fail(Errorf(InvalidArgument,"rpc server: %s takes no client messages",s.h.ServiceMethod))
+		return
+	}
+	v, body := newElem(s.in.Type().Elem())
+	if err := cc.ReadBody(body);err != nil{
+		s.fail(Errorf(InvalidArgument,"rpc server: read stream message error: %v",err))
+		return
+	}
+	s.mu.Lock()
+	var err error
+	switch{
+	case s.inEnd:
+		err = Errorf(InvalidArgument,"rpc server: stream message after the client closed sending")
+	case len(s.queue) >= s.size:
+		err = Errorf(ResourceExhausted,"rpc server: client overran the stream window of %d",s.size)
+	default:
+		s.queue = append(s.queue,v)
+	}
+	s.mu.Unlock()
+	if err != nil{
+		s.fail(err)
+		return
+	}
+	s.poke()
+}
+
+// the client is done sending, the method's channel is closed once it took everything
+func (s *serverStream)closeSend(){
+	s.mu.Lock()
+	s.inEnd = true
+	s.mu.Unlock()
+	s.poke()
+}
+
+func (s *serverStream)poke(){
+	select{
+	case s.inReady <- struct{}{}:
+	default:
+	}
+}
+
+// hand client messages to the method one at a time, so we know when to give credit back
+func (s *serverStream)pump(){
+	defer s.in.Close()
+	done := reflect.ValueOf(s.ctx.Done())
+	for{
+		s.mu.Lock()
+		if len(s.queue) == 0{
+			end := s.inEnd
+			s.mu.Unlock()
+			if end{
+				return
+			}
+			select{
+			case <-s.inReady:
+			case <-s.ctx.Done():
+				return
+			}
+			continue
+		}
+		v := s.queue[0]
+		s.queue[0] = reflect.Value{}
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		chosen, _, _ := reflect.Select([]reflect.SelectCase{
+			{Dir: reflect.SelectSend,Chan: s.in,Send: v},
+			{Dir: reflect.SelectRecv,Chan: done},
+		})
+		if chosen == 1{
+			return
+		}
+		s.mu.Lock()
+		n := creditDue(&s.consumed,s.size)
+		s.mu.Unlock()
+		if n > 0{
+			h := &codec.Header{Seq: s.h.Seq,Kind: codec.KindWindowUpdate,Window: uint32(n)}
+			if err := s.write(h,invalidRequest);err != nil{
+				log.Println("rpc server: send window update error:",err)
+			}
+		}
+	}
+}
+
+// ClientStream is the client side of a stream. it yields the replies as they arrive
+//	stream := client.Stream(ctx,"Logs.Tail",args,new(Line))
+//	defer stream.Close()
+//	for stream.Next(){
+//		line := stream.Reply().(*Line)
+//	}
+//	err := stream.Err()
+// streams opened with OpenStream send messages as well, and end sending with CloseSend
+type ClientStream struct{
+	client *Client
+	call *Call
+	kind codec.Kind // how the stream was opened
+	typ reflect.Type // type of the replies
+	size int // window of both directions, what the server settled on once sized
+	sized bool
+	sendWin *window // empty until the server tells its window
+	ready chan struct{} // poked whenever a reply arrives or the stream ends
+	end chan struct{} // closed once the stream ended
+	sendMu sync.Mutex // keep Send and CloseSend in order
+	sendClosed bool
+	mu sync.Mutex // protect following
+	queue []interface{} // replies received but not yet taken by Next
+	consumed int
+	finished bool
+	err error
+	trailer Metadata
+	cur interface{}
+}
+
+// Stream calls a server-streaming method, M(args, stream ServerStream) error.
+// reply points to a value of the type the method sends, it is only used for its type.
+// the stream is cancelled when ctx is done or Close is called
+func (client *Client)Stream(ctx context.Context, serviceMethod string, args, reply interface{})*ClientStream{
+	return client.openStream(ctx,serviceMethod,codec.KindStream,args,reply)
+}
+
+// OpenStream calls a method that takes client messages, M(in <-chan T, reply *R) error for
+// client streaming or M(in <-chan T, stream ServerStream) error for bidirectional streaming.
+// messages go out with Send, the replies, or the single reply, come back through Next
+func (client *Client)OpenStream(ctx context.Context, serviceMethod string, reply interface{})*ClientStream{
+	return client.openStream(ctx,serviceMethod,codec.KindClientStream,invalidRequest,reply)
+}
+
+func (client *Client)openStream(ctx context.Context, serviceMethod string, kind codec.Kind, args, reply interface{})*ClientStream{
+	md, _ := OutgoingMetadata(ctx)
+	deadline, _ := ctx.Deadline()
+	cs := &ClientStream{
+		client: client,
+		kind: kind,
+		size: DefaultStreamWindow,
+		ready: make(chan struct{},1),
+		end: make(chan struct{}),
+	}
+	if client.opt.StreamWindow > 0{
+		cs.size = client.opt.StreamWindow
+	}
+	cs.sendWin = newWindow(0)
+	cs.call = &Call{
+		ServiceMethod: serviceMethod,
+		Args: args,
+		Done: make(chan *Call,1),
+		Metadata: md,
+		deadline: deadline,
+		stream: cs,
+	}
+	t := reflect.TypeOf(reply)
+	if t == nil || t.Kind() != reflect.Ptr{
+		cs.finish(Errorf(InvalidArgument,"rpc client: stream reply must be a pointer, got %v",t),nil)
+		return cs
+	}
+	cs.typ = t.Elem()
+	client.send(cs.call)
+	if ctx.Done() != nil{
+		go func(){
+			select{
+			case <-ctx.Done():
+				cs.abort(Errorf(CodeOf(ctx.Err()),"rpc client: stream failed: %v",ctx.Err()))
+			case <-cs.end:
+			}
+		}()
+	}
+	return cs
+}
+
+// Send sends one message on a stream opened with OpenStream, waiting while the server
+// is a full window behind. once the stream ended it returns the stream's error
+func (cs *ClientStream)Send(args interface{})error{
+	cs.sendMu.Lock()
+	defer cs.sendMu.Unlock()
+	if cs.kind != codec.KindClientStream || cs.sendClosed{
+		return ErrStreamClosed
+	}
+	select{
+	case <-cs.end:
+		return cs.sendError()
+	default:
+	}
+	if !cs.sendWin.take(cs.end){
+		return cs.sendError()
+	}
+	return cs.client.write(&codec.Header{Seq: cs.call.Seq,Kind: codec.KindStreamMsg},args)
+}
+
+// CloseSend tells the server no more messages follow, the replies keep coming
+func (cs *ClientStream)CloseSend()error{
+	cs.sendMu.Lock()
+	defer cs.sendMu.Unlock()
+	if cs.kind != codec.KindClientStream || cs.sendClosed{
+		return nil
+	}
+	cs.sendClosed = true
+	select{
+	case <-cs.end:
+		return nil
+	default:
+	}
+	return cs.client.write(&codec.Header{Seq: cs.call.Seq,Kind: codec.KindStreamEnd},invalidRequest)
+}
+
+func (cs *ClientStream)sendError()error{
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.err != nil{
+		return cs.err
+	}
+	return ErrStreamClosed
+}
+
+// Next waits for the next reply, false once the stream ended or failed, see Err
+func (cs *ClientStream)Next()bool{
+	for{
+		cs.mu.Lock()
+		if len(cs.queue) > 0{
+			cs.cur = cs.queue[0]
+			cs.queue[0] = nil
+			cs.queue = cs.queue[1:]
+			n := creditDue(&cs.consumed,cs.size)
+			finished := cs.finished
+			cs.mu.Unlock()
+			if n > 0 && !finished{
+				h := &codec.Header{Seq: cs.call.Seq,Kind: codec.KindWindowUpdate,Window: uint32(n)}
+				if err := cs.client.write(h,invalidRequest);err != nil{
+					log.Println("rpc client: send window update error:",err)
+				}
+			}
+			return true
+		}
+		if cs.finished{
+			cs.cur = nil
+			cs.mu.Unlock()
+			return false
+		}
+		cs.mu.Unlock()
+		<-cs.ready
+	}
+}
+
+// Reply is the reply Next moved to, a pointer like the one given to Stream
+func (cs *ClientStream)Reply()interface{}{
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.cur
+}
+
+// Err is why the stream ended, nil when the method returned without error
+func (cs *ClientStream)Err()error{
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.err
+}
+
+// Trailer is the metadata the handler set, available once Next returned false
+func (cs *ClientStream)Trailer()Metadata{
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.trailer
+}
+
+// Close cancels the stream if it is still running, replies not yet taken are dropped
+func (cs *ClientStream)Close()error{
+	cs.abort(Errorf(Canceled,"rpc client: stream closed"))
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.queue = nil
+	return nil
+}
+
+// stop waiting for the server and tell it so
+func (cs *ClientStream)abort(err error){
+	if cs.client.removeCall(cs.call.Seq) == cs.call{
+		cs.client.sendCancel(cs.call.Seq)
+	}
+	cs.finish(err,nil)
+}
+
+// called by the receive loop with every message of the stream
+func (cs *ClientStream)push(reply interface{}){
+	cs.mu.Lock()
+	if !cs.finished{
+		cs.queue = append(cs.queue,reply)
+	}
+	cs.mu.Unlock()
+	cs.poke()
+}
+
+// the first reason the stream ended wins
+func (cs *ClientStream)finish(err error, trailer Metadata){
+	cs.mu.Lock()
+	if cs.finished{
+		cs.mu.Unlock()
+		return
+	}
+	cs.finished = true
+	cs.err = err
+	cs.trailer = trailer
+	close(cs.end)
+	cs.mu.Unlock()
+	cs.poke()
+}
+
+// the first window update is the window the server settled on, the rest hand back credit
+func (cs *ClientStream)window(n int){
+	cs.mu.Lock()
+	if !cs.sized{
+		cs.sized = true
+		cs.size = n
+	}
+	cs.mu.Unlock()
+	cs.sendWin.add(n)
+}
+
+func (cs *ClientStream)poke(){
+	select{
+	case cs.ready <- struct{}{}:
+	default:
+	}
+}
+
+// the stream a message with this seq belongs to, nil once the call is gone
+func (client *Client)streamOf(seq uint64)*ClientStream{
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if call := client.pending[seq];call != nil{
+		return call.stream
+	}
+	return nil
+}
+
+// handle a stream message or window update, messages of streams we gave up on are dropped
+func (client *Client)receiveStream(h *codec.Header)error{
+	cs := client.streamOf(h.Seq)
+	if cs == nil{
+		return client.cc.ReadBody(nil)
+	}
+	if h.Kind == codec.KindWindowUpdate{
+		cs.window(int(h.Window))
+		return client.cc.ReadBody(nil)
+	}
+	reply := reflect.New(cs.typ).Interface()
+	if err := client.cc.ReadBody(reply);err != nil{
+		return err
+	}
+	cs.push(reply)
+	return nil
+}
@@ -0,0 +1,304 @@
+package gorpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorpc/codec"
+	"testing"
+	"time"
+)
+
+type Line struct {
+	N    int
+	Text string
+}
+
+// Logs streams numbered lines
+type Logs chan error
+
+// send args.Num1 lines, then fail when args.Num2 is set
+func (l Logs) Tail(ctx context.Context, args Args, stream ServerStream) error {
+	for i := 0; i < args.Num1; i++ {
+		if err := stream.Send(&Line{N: i, Text: fmt.Sprint("line ", i)}); err != nil {
+			return err
+		}
+	}
+	_ = SetTrailer(ctx, Metadata{"sent": fmt.Sprint(args.Num1)})
+	if args.Num2 != 0 {
+		return Errorf(ResourceExhausted, "out of lines")
+	}
+	return nil
+}
+
+// send until the client goes away and report why
+func (l Logs) Follow(args Args, stream ServerStream) error {
+	for i := 0; ; i++ {
+		if err := stream.Send(&Line{N: i}); err != nil {
+			<-stream.Context().Done()
+			l <- stream.Context().Err()
+			return err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServerStream(t *testing.T) {
+	server := NewServer()
+	logs := make(Logs, 1)
+	var foo Foo
+	_ = server.Register(logs)
+	_ = server.Register(&foo)
+	opts := map[string]*Option{
+		"gob":        {CodecType: codec.GobType},
+		"json":       {CodecType: codec.JsonType},
+		"msgpack":    {CodecType: codec.MsgpackType},
+		"gob framed": {CodecType: codec.GobType, Framing: true},
+	}
+	for name, opt := range opts {
+		t.Run(name, func(t *testing.T) {
+			client := newPipeClient(t, server, opt)
+			stream := client.Stream(context.Background(), "Logs.Tail", Args{Num1: 100}, new(Line))
+			n := 0
+			for stream.Next() {
+				line := stream.Reply().(*Line)
+				_assert(line.N == n && line.Text == fmt.Sprint("line ", n), "expect line %d, got %+v", n, line)
+				n++
+			}
+			_assert(stream.Err() == nil && n == 100, "expect 100 lines, got %d, %v", n, stream.Err())
+			_assert(stream.Trailer().Get("sent") == "100", "expect trailer, got %v", stream.Trailer())
+
+			// a failing handler ends the stream with its error after the lines it sent
+			stream = client.Stream(context.Background(), "Logs.Tail", Args{Num1: 3, Num2: 1}, new(Line))
+			n = 0
+			for stream.Next() {
+				n++
+			}
+			_assert(n == 3 && CodeOf(stream.Err()) == ResourceExhausted, "expect 3 lines and an error, got %d, %v", n, stream.Err())
+
+			// plain calls are not interleaved wrongly with stream messages
+			var sum int
+			err := client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+			_assert(err == nil && sum == 3, "expect call to work next to streams, got %d, %v", sum, err)
+		})
+	}
+}
+
+func TestServerStreamCancel(t *testing.T) {
+	server := NewServer()
+	logs := make(Logs, 1)
+	_ = server.Register(logs)
+	client := newPipeClient(t, server, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := client.Stream(ctx, "Logs.Follow", Args{}, new(Line))
+	for i := 0; i < 5; i++ {
+		_assert(stream.Next(), "expect line %d, got %v", i, stream.Err())
+	}
+	cancel()
+	select {
+	case err := <-logs:
+		_assert(errors.Is(err, context.Canceled), "expect handler to be cancelled, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("handler not cancelled")
+	}
+	for stream.Next() {
+	}
+	_assert(CodeOf(stream.Err()) == Canceled, "expect Canceled, got %v", stream.Err())
+
+	// Close stops a stream as well
+	stream = client.Stream(context.Background(), "Logs.Follow", Args{}, new(Line))
+	_assert(stream.Next(), "expect a line, got %v", stream.Err())
+	_ = stream.Close()
+	<-logs
+	_assert(!stream.Next() && CodeOf(stream.Err()) == Canceled, "expect closed stream, got %v", stream.Err())
+}
+
+func TestStreamKindMismatch(t *testing.T) {
+	server := NewServer()
+	logs := make(Logs, 1)
+	var foo Foo
+	_ = server.Register(logs)
+	_ = server.Register(&foo)
+	client := newPipeClient(t, server, nil)
+
+	var reply int
+	err := client.Call(context.Background(), "Logs.Tail", Args{}, &reply)
+	_assert(CodeOf(err) == InvalidArgument, "expect calling a stream to fail, got %v", err)
+	stream := client.Stream(context.Background(), "Foo.Sum", Args{}, new(int))
+	_assert(!stream.Next() && CodeOf(stream.Err()) == InvalidArgument, "expect streaming a call to fail, got %v", stream.Err())
+	stream = client.Stream(context.Background(), "Logs.Tail", Args{}, Line{})
+	_assert(!stream.Next() && CodeOf(stream.Err()) == InvalidArgument, "expect non pointer reply to fail, got %v", stream.Err())
+}
+
+type Summary struct {
+	Chunks, Bytes int
+}
+
+// Files takes client streams
+type Files chan error
+
+// add up the uploaded chunks
+func (f Files) Upload(in <-chan []byte, reply *Summary) error {
+	for chunk := range in {
+		reply.Chunks++
+		reply.Bytes += len(chunk)
+	}
+	return nil
+}
+
+// echo lines back as they arrive, failing on "bad"
+func (f Files) Echo(ctx context.Context, in <-chan *Line, stream ServerStream) error {
+	for line := range in {
+		if line.Text == "bad" {
+			return Errorf(InvalidArgument, "bad line %d", line.N)
+		}
+		if err := stream.Send(line); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// never read, until the client goes away
+func (f Files) Stall(ctx context.Context, in <-chan *Line, reply *int) error {
+	<-ctx.Done()
+	f <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestClientStream(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(make(Files, 1))
+	client := newPipeClient(t, server, &Option{StreamWindow: 4})
+
+	stream := client.OpenStream(context.Background(), "Files.Upload", new(Summary))
+	for i := 0; i < 100; i++ {
+		err := stream.Send(make([]byte, i))
+		_assert(err == nil, "failed to send chunk %d: %v", i, err)
+	}
+	_assert(stream.CloseSend() == nil, "failed to close sending")
+	_assert(stream.Next(), "expect a reply, got %v", stream.Err())
+	sum := stream.Reply().(*Summary)
+	_assert(sum.Chunks == 100 && sum.Bytes == 99*100/2, "expect every chunk counted, got %+v", sum)
+	_assert(!stream.Next() && stream.Err() == nil, "expect a single reply, got %v", stream.Err())
+	_assert(stream.Send([]byte{1}) == ErrStreamClosed, "expect send after CloseSend to fail")
+
+	// calling it the wrong way is refused
+	s := client.Stream(context.Background(), "Files.Upload", Args{}, new(Summary))
+	_assert(!s.Next() && CodeOf(s.Err()) == InvalidArgument, "expect Stream on a client stream to fail, got %v", s.Err())
+}
+
+func TestBidiStream(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(make(Files, 1))
+	for _, opt := range []*Option{{StreamWindow: 1}, {CodecType: codec.JsonType}, {CodecType: codec.MsgpackType, Framing: true}} {
+		client := newPipeClient(t, server, opt)
+		stream := client.OpenStream(context.Background(), "Files.Echo", new(Line))
+		// lock step
+		for i := 0; i < 10; i++ {
+			_assert(stream.Send(&Line{N: i}) == nil, "failed to send line %d", i)
+			_assert(stream.Next() && stream.Reply().(*Line).N == i, "expect line %d back, got %v", i, stream.Err())
+		}
+		// more than a window in flight, replies stay in order after half-close
+		go func() {
+			for i := 10; i < 50; i++ {
+				_ = stream.Send(&Line{N: i})
+			}
+			_ = stream.CloseSend()
+		}()
+		n := 10
+		for stream.Next() {
+			_assert(stream.Reply().(*Line).N == n, "expect line %d, got %+v", n, stream.Reply())
+			n++
+		}
+		_assert(n == 50 && stream.Err() == nil, "expect 50 lines, got %d, %v", n, stream.Err())
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	server := NewServer()
+	files := make(Files, 1)
+	var foo Foo
+	_ = server.Register(files)
+	_ = server.Register(make(Logs, 1))
+	_ = server.Register(&foo)
+	client := newPipeClient(t, server, &Option{StreamWindow: 2})
+
+	// the handler's error ends only its own stream
+	stream := client.OpenStream(context.Background(), "Files.Echo", new(Line))
+	other := client.OpenStream(context.Background(), "Files.Echo", new(Line))
+	_ = stream.Send(&Line{N: 1, Text: "bad"})
+	for stream.Next() {
+	}
+	_assert(CodeOf(stream.Err()) == InvalidArgument, "expect the handler's error, got %v", stream.Err())
+	_assert(CodeOf(stream.Send(&Line{})) == InvalidArgument, "expect send to report the stream's error")
+	_assert(other.Send(&Line{N: 2}) == nil && other.Next(), "expect the other stream to carry on, got %v", other.Err())
+	_ = other.Close()
+
+	// a server that does not read holds up its own stream, not the connection
+	stalled := client.OpenStream(context.Background(), "Files.Stall", new(int))
+	sent := make(chan int)
+	go func() {
+		n := 0
+		for stalled.Send(&Line{N: n}) == nil {
+			n++
+		}
+		sent <- n
+	}()
+	var sum int
+	err := client.Call(context.Background(), "Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "expect calls to pass a stalled stream, got %v", err)
+
+	// a client that does not read holds up its own stream, not the connection
+	logs := client.Stream(context.Background(), "Logs.Tail", Args{Num1: 1000}, new(Line))
+	time.Sleep(20 * time.Millisecond)
+	err = client.Call(context.Background(), "Foo.Sum", Args{Num1: 2, Num2: 2}, &sum)
+	_assert(err == nil && sum == 4, "expect calls to pass a stream nobody reads, got %v", err)
+	_ = logs.Close()
+
+	// cancelling stops the handler and the sender
+	_ = stalled.Close()
+	_assert(<-files == context.Canceled, "expect stalled handler to be cancelled")
+	_assert(<-sent == 2, "expect sending to stop at the window")
+}
+
+func TestStreamWindowClamped(t *testing.T) {
+	server := NewServer()
+	server.MaxStreamWindow = 4
+	_ = server.Register(make(Files, 1))
+
+	// a client asking for more gets the server's window, and streams within it
+	client := newPipeClient(t, server, &Option{StreamWindow: 1 << 20})
+	stream := client.OpenStream(context.Background(), "Files.Echo", new(Line))
+	go func() {
+		for i := 0; i < 50; i++ {
+			_ = stream.Send(&Line{N: i})
+		}
+		_ = stream.CloseSend()
+	}()
+	n := 0
+	for stream.Next() {
+		n++
+	}
+	_assert(n == 50 && stream.Err() == nil, "expect 50 lines, got %d, %v", n, stream.Err())
+	stream.mu.Lock()
+	size := stream.size
+	stream.mu.Unlock()
+	_assert(size == 4, "expect the client to use the server's window, got %d", size)
+
+	// the window in use is announced first, and a client overrunning it fails the stream
+	conn, cc := newRawConn(t, server, 0)
+	_assert(cc.Write(&codec.Header{ServiceMethod: "Files.Stall", Seq: 1, Kind: codec.KindClientStream, Window: 0xffffffff}, invalidRequest) == nil, "failed to open stream")
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	var h codec.Header
+	_assert(cc.ReadHeader(&h) == nil && cc.ReadBody(nil) == nil, "failed to read the window")
+	_assert(h.Kind == codec.KindWindowUpdate && h.Window == 4, "expect a window of 4, got %+v", h)
+	go func() {
+		for i := 0; i < 10; i++ {
+			_ = cc.Write(&codec.Header{Seq: 1, Kind: codec.KindStreamMsg}, &Line{N: i})
+		}
+	}()
+	h = expectOneResponse(t, conn, cc, 1, 100*time.Millisecond)
+	_assert(Code(h.Code) == ResourceExhausted, "expect the overrun to fail the stream, got %v (%s)", Code(h.Code), h.Error)
+}
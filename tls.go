@@ -0,0 +1,107 @@
+package gorpc
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+)
+
+// Peer describes the other end of a connection
+type Peer struct{
+	Addr net.Addr // remote address, nil when the connection is not a net.Conn
+	TLS *tls.ConnectionState // nil on plaintext connections
+}
+
+// Identity returns the common name of the verified client certificate,
+// empty when the client did not present one or it was not verified
+func (p *Peer)Identity()string{
+	if p.TLS == nil || len(p.TLS.VerifiedChains) == 0 || len(p.TLS.VerifiedChains[0]) == 0{
+		return ""
+	}
+	return p.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+type peerKey struct{}
+
+// PeerFromContext returns the peer of the connection a request arrived on,
+// for use in handlers and interceptors
+func PeerFromContext(ctx context.Context)(*Peer,bool){
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p,ok
+}
+
+// finish the tls handshake first, so the peer's certificate is known before any request.
+// a client that does not finish it within timeout is dropped
+func newPeer(conn io.ReadWriteCloser, timeout time.Duration)(*Peer,error){
+	p := new(Peer)
+	if nc, ok := conn.(net.Conn);ok{
+		p.Addr = nc.RemoteAddr()
+	}
+	if tc, ok := conn.(*tls.Conn);ok{
+		ctx := context.Background()
+		if timeout > 0{
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx,timeout)
+			defer cancel()
+		}
+		if err := tc.HandshakeContext(ctx);err != nil{
+			return nil, err
+		}
+		state := tc.ConnectionState()
+		p.TLS = &state
+	}
+	return p,nil
+}
+
+// ServeTLS accepts connections on lis and serves them over tls, until lis fails.
+// it returns the error that stopped it, ErrServerClosed after Shutdown.
+// set config.ClientAuth to tls.RequireAndVerifyClientCert and config.ClientCAs for mutual tls
+func (server *Server)ServeTLS(lis net.Listener, config *tls.Config)error{
+	return server.serve(tls.NewListener(lis,config))
+}
+
+// ListenAndServeTLS listens on the address and serves tls connections until the listener fails,
+// it returns the error that stopped it like ServeTLS
+func (server *Server)ListenAndServeTLS(network, address string, config *tls.Config)error{
+	lis, err := net.Listen(network,address)
+	if err != nil{
+		return err
+	}
+	return server.ServeTLS(lis,config)
+}
+
+func ServeTLS(lis net.Listener, config *tls.Config)error{return DefaultServer.ServeTLS(lis,config)}
+
+func ListenAndServeTLS(network, address string, config *tls.Config)error{
+	return DefaultServer.ListenAndServeTLS(network,address,config)
+}
+
+// wrap f so it runs over a tls client connection, the handshake counts against ConnectTimeout
+func tlsClientFunc(f newClientFunc, address string, config *tls.Config)newClientFunc{
+	if config == nil{
+		config = &tls.Config{}
+	}
+	if config.ServerName == ""{
+		config = config.Clone()
+		if host, _, err := net.SplitHostPort(address);err == nil{
+			config.ServerName = host
+		}else{
+			config.ServerName = address
+		}
+	}
+	return func(conn net.Conn, opt *Option)(*Client,error){
+		tc := tls.Client(conn,config)
+		if err := tc.Handshake();err != nil{
+			return nil, err
+		}
+		return f(tc,opt)
+	}
+}
+
+// DialTLS connects to a server started with ServeTLS.
+// put a client certificate into config.Certificates for mutual tls
+func DialTLS(network, address string, config *tls.Config, opts ...*Option)(*Client,error){
+	return dialTimeout(tlsClientFunc(NewClient,address,config),network,address,opts...)
+}
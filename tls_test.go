@@ -0,0 +1,135 @@
+package gorpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Whoami tells the caller who the server thinks it is
+type Whoami int
+
+func (w Whoami) Name(ctx context.Context, args Args, reply *string) error {
+	if p, ok := PeerFromContext(ctx); ok {
+		*reply = p.Identity()
+	}
+	return nil
+}
+
+// issue a certificate for name, signed by parent or self-signed when parent is nil
+func newTestCert(t *testing.T, name string, parent *tls.Certificate, isCA bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "test ca", nil, true)
+	serverCert := newTestCert(t, "127.0.0.1", &ca, false)
+	clientCert := newTestCert(t, "billing-service", &ca, false)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	server := NewServer()
+	var w Whoami
+	_ = server.Register(&w)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.ServeTLS(l, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	addr := l.Addr().String()
+
+	// the verified client identity reaches the handler
+	client, err := DialTLS("tcp", addr, &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}})
+	_assert(err == nil, "failed to dial tls: %v", err)
+	var name string
+	err = client.Call(context.Background(), "Whoami.Name", Args{}, &name)
+	_assert(err == nil && name == "billing-service", "expect client identity, got %q, %v", name, err)
+	_ = client.Close()
+
+	// same through XDial
+	client, err = XDial("tls@"+addr, &Option{TLSConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}})
+	_assert(err == nil, "failed to xdial tls: %v", err)
+	_ = client.Close()
+
+	// clients without a certificate are refused
+	_, err = DialTLS("tcp", addr, &tls.Config{RootCAs: pool}, &Option{ConnectTimeout: time.Second})
+	_assert(err != nil, "expect client without certificate to be refused")
+}
+
+func TestServeTLSErrors(t *testing.T) {
+	cert := newTestCert(t, "127.0.0.1", nil, false)
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	// the error that ends the accept loop is returned
+	server := NewServer()
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	done := make(chan error, 1)
+	go func() { done <- server.ServeTLS(l, config) }()
+	time.Sleep(20 * time.Millisecond)
+	_ = l.Close()
+	select {
+	case err := <-done:
+		_assert(errors.Is(err, net.ErrClosed), "expect the listener's error, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("ServeTLS did not return after its listener failed")
+	}
+
+	// Shutdown ends it with ErrServerClosed
+	server = NewServer()
+	go func() { done <- server.ListenAndServeTLS("tcp", "127.0.0.1:0", config) }()
+	time.Sleep(20 * time.Millisecond)
+	_assert(server.Shutdown(context.Background()) == nil, "expect shutdown to finish")
+	_assert(<-done == ErrServerClosed, "expect ErrServerClosed after Shutdown")
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	cert := newTestCert(t, "127.0.0.1", nil, false)
+	server := NewServer()
+	server.HandshakeTimeout = 50 * time.Millisecond
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.ServeTLS(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer func() { _ = l.Close() }()
+
+	// a client that never starts the handshake is dropped
+	conn, err := net.Dial("tcp", l.Addr().String())
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	_assert(err != nil && !errors.Is(err, os.ErrDeadlineExceeded), "expect the server to drop the connection, got %v", err)
+}
@@ -12,7 +12,7 @@ import (
 type XClient struct{
 	d Discovery
 	mode SelectMode
-	opt *Option
+	opt *Option // also carries the client interceptors every dialed client uses
 	mu sync.Mutex
 	clients map[string]*Client
 }
@@ -105,6 +105,7 @@ func (xc *XClient)Broadcast(ctx context.Context ,serviceMethod string, args,repl
 	replyDone := reply == nil
 	// use cancel we can fail fast if we encounter some problem
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	// boardcast to all server instance
 	for _,rpcAddr := range servers{
 		wg.Add(1)